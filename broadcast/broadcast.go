@@ -2,7 +2,7 @@ package broadcast
 
 import (
 	"encoding/json"
-	"sync"
+	"strconv"
 	"time"
 
 	"github.com/bitly/go-nsq"
@@ -10,8 +10,8 @@ import (
 	"github.com/segmentio/go-log"
 	"github.com/segmentio/go-stats"
 	"github.com/segmentio/nsq_to_redis/ratelimit"
+	"github.com/segmentio/nsq_to_redis/template"
 	"github.com/segmentio/statsdclient"
-	"github.com/tidwall/gjson"
 )
 
 type RedisPool interface {
@@ -23,20 +23,142 @@ type Handler interface {
 	Handle(Conn, *Message) error
 }
 
-// Message is a parsed message.
+// Transformer rewrites messages before they are passed to handlers.
+type Transformer interface {
+	Transform(*Message) error
+}
+
+// Predicate matches messages.
+type Predicate interface {
+	Match(*Message) bool
+}
+
+// Any returns a predicate matching the messages matching any of ps,
+// or nil, which matches every message, if one of them is nil.
+func Any(ps ...Predicate) Predicate {
+	for _, p := range ps {
+		if p == nil {
+			return nil
+		}
+	}
+	if len(ps) == 1 {
+		return ps[0]
+	}
+	return anyOf(ps)
+}
+
+// anyOf matches the messages matching any of its predicates.
+type anyOf []Predicate
+
+func (a anyOf) Match(m *Message) bool {
+	for _, p := range a {
+		if p.Match(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// Decoder decodes message bodies which aren't JSON to a JSON document
+// templates are evaluated against, or nil to pass the body as is.
+type Decoder interface {
+	Decode(body []byte) (json.RawMessage, error)
+}
+
+// Message is a parsed message. Raw messages have no JSON document.
 type Message struct {
 	ID   nsq.MessageID
 	JSON json.RawMessage
+	Body []byte
+
+	// NSQ metadata.
+	Topic       string
+	Channel     string
+	Attempts    uint16
+	NSQDAddress string
+	Timestamp   time.Time
+	ReceivedAt  time.Time
+
+	ctx *template.Context
+}
+
+// Context returns the template context of the message, with
+// the NSQ metadata available as reserved variables. It is
+// created once and shared by the handlers, so the document
+// is only scanned once per path.
+func (m *Message) Context() *template.Context {
+	if m.ctx != nil {
+		return m.ctx
+	}
+
+	vars := map[string]string{
+		"id":       string(m.ID[:]),
+		"attempts": strconv.Itoa(int(m.Attempts)),
+	}
+
+	if m.Topic != "" {
+		vars["topic"] = m.Topic
+	}
+
+	if m.Channel != "" {
+		vars["channel"] = m.Channel
+	}
+
+	if m.NSQDAddress != "" {
+		vars["nsqd"] = m.NSQDAddress
+	}
+
+	if !m.Timestamp.IsZero() {
+		vars["timestamp"] = m.Timestamp.UTC().Format(time.RFC3339Nano)
+	}
+
+	m.ctx = &template.Context{
+		JSON: m.JSON,
+		Vars: vars,
+	}
+	return m.ctx
 }
 
 // Options for broadcast.
 type Options struct {
+	Topic         string
+	Channel       string
 	Redis         RedisPool
 	Metrics       *statsd.Client
 	Ratelimiter   *ratelimit.Ratelimiter
 	RatelimitKey  string
+	Decoder       Decoder       // Decodes bodies, nil expects JSON
+	Filter        Predicate     // Discards messages not matching, nil disables
+	Transformers  []Transformer // Applied in order before handlers
 	Log           *log.Logger
 	FlushInterval time.Duration
+
+	// When a flush interval is set, the buffered commands are
+	// also flushed as soon as either limit is reached (<= 0 disables).
+	FlushMaxCommands int
+	FlushMaxBytes    int
+
+	// Number of connections commands are pipelined on when a
+	// flush interval is set, sharded by key (defaults to 1).
+	Pipelines int
+
+	// Wrap the commands of the handlers writing to the same pool for a
+	// message in MULTI/EXEC, a failed transaction fails the message.
+	// Handlers writing to other pools, such as another database, are
+	// in a transaction of their own, so the message may be committed
+	// to one pool and failed by another. When a flush interval is set,
+	// the message is finished or requeued once flushed. Transactions
+	// can't be sharded by key, so Atomic can't be used with several
+	// Pipelines.
+	Atomic bool
+
+	// Messages whose body exceeds MaxMessageBytes (<= 0 disables) are
+	// passed to the DeadLetter handler instead of the others if set,
+	// once transformed, else shortened by Truncate if set, else skipped.
+	// Messages still too large once truncated are skipped.
+	MaxMessageBytes int
+	Truncate        Transformer
+	DeadLetter      Handler
 }
 
 // Broadcast consumer distributes messages to N handlers.
@@ -44,12 +166,8 @@ type Broadcast struct {
 	Done chan struct{}
 	*Options
 
-	handlers []Handler
-	stats    *stats.Stats
-
-	// Single connection, channel and mutex are used when applying a flush interval
-	conn  Conn
-	mutex sync.Mutex
+	targets []*target
+	stats   *stats.Stats
 }
 
 // New broadcast consumer.
@@ -65,30 +183,143 @@ func New(o *Options) *Broadcast {
 
 	if o.FlushInterval < 0 {
 		panic("FlushInterval must not be a negative duration")
-	} else if o.FlushInterval > 0 {
-		conn := NewConn(o.Redis.Get())
-		broadcast.conn = conn
-		broadcast.flushOnInterval(conn)
 	}
 
+	if o.Atomic && o.FlushInterval > 0 && o.Pipelines > 1 {
+		panic("Atomic must not be used with several Pipelines")
+	}
+
+	broadcast.target(o.Redis)
 	return &broadcast
 }
 
-// Add handler.
+// Add handler receiving every message.
 func (b *Broadcast) Add(h Handler) {
-	b.handlers = append(b.handlers, h)
+	b.AddTo(b.Redis, h)
+}
+
+// Route adds handlers receiving the messages matching p, or every
+// message when p is nil. Each call adds the handlers again, so a
+// handler receiving messages of several routes should be routed
+// once with Any to not be passed a message twice.
+func (b *Broadcast) Route(name string, p Predicate, handlers ...Handler) {
+	b.RouteTo(b.Redis, name, p, handlers...)
+}
+
+// RouteTo is Route with handlers writing to the given pool.
+func (b *Broadcast) RouteTo(pool RedisPool, name string, p Predicate, handlers ...Handler) {
+	for _, h := range handlers {
+		if p != nil {
+			h = b.Filtered("route."+name, p, h)
+		}
+		b.AddTo(pool, h)
+	}
+}
+
+// Filtered returns a handler passing the messages matching p to h,
+// others are counted as discarded by the filter with the given name.
+func (b *Broadcast) Filtered(name string, p Predicate, h Handler) Handler {
+	return &filtered{b, name, p, h}
+}
+
+// filtered is a handler with a predicate.
+type filtered struct {
+	broadcast *Broadcast
+	name      string
+	Predicate
+	Handler
 }
 
+// Handle passes the message to the handler if it matches.
+func (f *filtered) Handle(c Conn, m *Message) error {
+	if !f.Match(m) {
+		f.broadcast.stats.Incr("filter." + f.name + ".discard")
+		f.broadcast.Metrics.Incr("counts.filter." + f.name + ".discard")
+		return nil
+	}
+	return f.Handler.Handle(c, m)
+}
+
+// AddTo adds a handler writing to the given pool,
+// for example one selecting another database.
+func (b *Broadcast) AddTo(pool RedisPool, h Handler) {
+	t := b.target(pool)
+	t.handlers = append(t.handlers, h)
+}
+
+// target returns the target for the given pool,
+// creating it and its pipelines if needed.
+func (b *Broadcast) target(pool RedisPool) *target {
+	for _, t := range b.targets {
+		if t.pool == pool {
+			return t
+		}
+	}
+
+	t := &target{pool: pool}
+	if b.FlushInterval > 0 {
+		n := b.Pipelines
+		if n <= 0 {
+			n = 1
+		}
+
+		for i := 0; i < n; i++ {
+			p := &pipeline{pool: pool, conn: &conn{conn: pool.Get()}}
+			t.pipelines = append(t.pipelines, p)
+			b.flushOnInterval(p)
+		}
+	}
+
+	b.targets = append(b.targets, t)
+	return t
+}
+
+// now returns the current time, messages are received at it.
+var now = time.Now
+
 // HandleMessage parses distributes messages to each delegate.
 func (b *Broadcast) HandleMessage(msg *nsq.Message) error {
-	start := time.Now()
+	start := now()
 
 	// parse
 	m := new(Message)
 	m.ID = msg.ID
-	err := json.Unmarshal(msg.Body, &m.JSON)
-	if err != nil {
-		b.Log.Error("error parsing json: %s", err)
+	m.Topic = b.Topic
+	m.Channel = b.Channel
+	m.Attempts = msg.Attempts
+	m.NSQDAddress = msg.NSQDAddress
+	m.Timestamp = time.Unix(0, msg.Timestamp)
+	m.ReceivedAt = start
+	m.Body = msg.Body
+	if err := b.decode(m); err != nil {
+		b.Metrics.Incr("errors.decode")
+		b.Log.Error("error decoding %s: %s", m.ID, err)
+		return nil
+	}
+
+	// size
+	if b.MaxMessageBytes > 0 && len(m.Body) > b.MaxMessageBytes {
+		if b.DeadLetter != nil {
+			// dead letters are masked and hashed like other writes
+			if !b.transform(m) {
+				return nil
+			}
+			return b.deadLetter(m)
+		}
+
+		if !b.truncate(m) {
+			b.stats.Incr("oversize.discard")
+			b.Metrics.Incr("counts.oversize.discard")
+			b.Log.Debug("message %s exceeds %d bytes, discarding message", m.ID, b.MaxMessageBytes)
+			return nil
+		}
+	}
+
+	// filter
+	if b.Filter != nil && !b.Filter.Match(m) {
+		b.stats.Incr("filter.discard")
+		b.Metrics.Incr("counts.filter.discard")
+		b.Log.Debug("filter not matched, discarding message")
 		return nil
 	}
 
@@ -100,20 +331,19 @@ func (b *Broadcast) HandleMessage(msg *nsq.Message) error {
 		return nil
 	}
 
-	conn, done := b.getConn()
-	defer done()
-
-	for _, h := range b.handlers {
-		err := h.Handle(conn, m)
-		if err != nil {
-			return err
-		}
+	// transform
+	if !b.transform(m) {
+		return nil
 	}
 
+	var err error
 	if b.FlushInterval == 0 {
-		if err := b.flush(conn); err != nil {
-			return err
-		}
+		err = b.send(m)
+	} else {
+		err = b.buffer(m, msg)
+	}
+	if err != nil {
+		return err
 	}
 
 	b.Metrics.Duration("timers.broadcast", time.Since(start))
@@ -122,43 +352,185 @@ func (b *Broadcast) HandleMessage(msg *nsq.Message) error {
 
 // Flushes all messages, then sends on the Done channel.
 func (b *Broadcast) Stop() {
-	if b.FlushInterval > 0 {
-		conn, done := b.getConn()
-		defer done()
-		b.flush(conn)
+	for _, t := range b.targets {
+		for _, p := range t.pipelines {
+			p.Lock()
+			b.flushPipeline(p)
+			p.Unlock()
+		}
 	}
 
 	b.Done <- struct{}{}
 }
 
-func (b *Broadcast) getConn() (conn Conn, done func()) {
-	if b.FlushInterval == 0 {
-		db := b.Redis.Get()
-		conn = NewConn(db)
-		done = func() {
-			db.Close()
+// send applies the handlers of each target to the
+// message on a pooled connection and flushes immediately.
+func (b *Broadcast) send(m *Message) error {
+	for _, t := range b.targets {
+		if err := b.sendTo(t, m); err != nil {
+			return err
 		}
-	} else {
-		b.mutex.Lock()
-		conn = b.conn
-		done = func() {
-			b.mutex.Unlock()
+	}
+
+	return nil
+}
+
+func (b *Broadcast) sendTo(t *target, m *Message) error {
+	db := t.pool.Get()
+	defer db.Close()
+	conn := &conn{conn: db}
+
+	if b.Atomic {
+		conn.Send("MULTI")
+	}
+
+	for _, h := range t.handlers {
+		err := h.Handle(conn, m)
+		if err != nil {
+			return err
+		}
+	}
+
+	var txErr error
+	if b.Atomic {
+		conn.exec(func(err error) {
+			txErr = err
+		})
+	}
+
+	if err := b.flush(conn); err != nil {
+		return err
+	}
+
+	if txErr != nil {
+		b.Metrics.Incr("errors.exec")
+		b.Log.Error("exec %s: %s", m.ID, txErr)
+		return txErr
+	}
+
+	return nil
+}
+
+// buffer applies the handlers to the message and writes the
+// resulting commands to the pipelines of their targets.
+func (b *Broadcast) buffer(m *Message, msg *nsq.Message) error {
+	batches := make([]*batch, len(b.targets))
+	for i, t := range b.targets {
+		batches[i] = new(batch)
+		for _, h := range t.handlers {
+			err := h.Handle(batches[i], m)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if b.Atomic {
+		return b.bufferTx(batches, msg)
+	}
+
+	for i, t := range b.targets {
+		for _, cmd := range batches[i].commands {
+			p := t.pipeline(cmd.key())
+			p.Lock()
+			err := p.conn.Send(cmd.name, cmd.args...)
+			if err == nil && p.conn.exceeds(b.FlushMaxCommands, b.FlushMaxBytes) {
+				err = b.flushPipeline(p)
+			}
+			p.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// bufferTx writes each batch as a transaction to the pipeline of
+// its first key. The message is responded to once the pipelines
+// are flushed and the results of the transactions are known.
+func (b *Broadcast) bufferTx(batches []*batch, msg *nsq.Message) error {
+	r := &response{broadcast: b, msg: msg}
+	for _, batch := range batches {
+		if len(batch.commands) > 0 {
+			r.pending++
+		}
+	}
+
+	if r.pending == 0 {
+		return nil
+	}
+
+	msg.DisableAutoResponse()
+
+	var first error
+	for i, t := range b.targets {
+		if len(batches[i].commands) == 0 {
+			continue
+		}
+
+		err := b.writeTx(t, batches[i], r)
+		if err != nil && first == nil {
+			first = err
 		}
 	}
 
-	return conn, done
+	return first
 }
 
-func (b *Broadcast) flushOnInterval(conn Conn) {
+// writeTx writes the batch wrapped in MULTI/EXEC to a pipeline.
+func (b *Broadcast) writeTx(t *target, batch *batch, r *response) error {
+	p := t.pipeline(batch.commands[0].key())
+	p.Lock()
+	defer p.Unlock()
+
+	err := p.conn.Send("MULTI")
+	for _, cmd := range batch.commands {
+		if err == nil {
+			err = p.conn.Send(cmd.name, cmd.args...)
+		}
+	}
+
+	if err == nil {
+		err = p.conn.exec(r.done)
+	}
+
+	if err != nil {
+		r.done(err)
+		return err
+	}
+
+	if p.conn.exceeds(b.FlushMaxCommands, b.FlushMaxBytes) {
+		b.flushPipeline(p)
+	}
+
+	return nil
+}
+
+func (b *Broadcast) flushOnInterval(p *pipeline) {
 	go func() {
 		for range time.Tick(b.FlushInterval) {
-			b.mutex.Lock()
-			b.flush(conn)
-			b.mutex.Unlock()
+			p.Lock()
+			b.flushPipeline(p)
+			p.Unlock()
 		}
 	}()
 }
 
+// flushPipeline flushes the pipeline and replaces its
+// connection with a new one from the pool if it broke,
+// for example after a read or write timeout.
+func (b *Broadcast) flushPipeline(p *pipeline) error {
+	err := b.flush(p.conn)
+	if err != nil && p.conn.conn.Err() != nil {
+		p.conn.conn.Close()
+		p.conn = &conn{conn: p.pool.Get()}
+	}
+
+	return err
+}
+
 func (b *Broadcast) flush(conn Conn) error {
 	err := conn.Flush()
 	if err != nil {
@@ -170,12 +542,95 @@ func (b *Broadcast) flush(conn Conn) error {
 	return nil
 }
 
+// decode sets the JSON document of the message from its body,
+// JSON bodies are validated and used without copying them.
+func (b *Broadcast) decode(m *Message) error {
+	if b.Decoder == nil {
+		doc, ok := validJSON(m.Body)
+		if !ok {
+			return ErrInvalidJSON
+		}
+		m.JSON = doc
+		return nil
+	}
+
+	doc, err := b.Decoder.Decode(m.Body)
+	if err != nil {
+		return err
+	}
+
+	m.JSON = doc
+	return nil
+}
+
+// deadLetter passes an oversize message to the dead letter handler.
+func (b *Broadcast) deadLetter(m *Message) error {
+	db := b.Redis.Get()
+	defer db.Close()
+	conn := &conn{conn: db}
+
+	if err := b.DeadLetter.Handle(conn, m); err != nil {
+		return err
+	}
+
+	if err := b.flush(conn); err != nil {
+		return err
+	}
+
+	b.stats.Incr("oversize.dead_letter")
+	b.Metrics.Incr("counts.oversize.dead_letter")
+	return nil
+}
+
+// truncate shortens an oversize message, it returns
+// false if it can't and the message must be discarded.
+func (b *Broadcast) truncate(m *Message) bool {
+	if b.Truncate == nil || m.JSON == nil {
+		return false
+	}
+
+	if err := b.Truncate.Transform(m); err != nil {
+		b.Metrics.Incr("errors.truncate")
+		b.Log.Error("truncating %s: %s", m.ID, err)
+		return false
+	}
+
+	m.ctx = nil
+	if len(m.JSON) > b.MaxMessageBytes {
+		return false
+	}
+
+	b.stats.Incr("oversize.truncate")
+	b.Metrics.Incr("counts.oversize.truncate")
+	return true
+}
+
+// transform applies the transformers to the message, it returns
+// false if one failed and the message must be discarded.
+func (b *Broadcast) transform(m *Message) bool {
+	if len(b.Transformers) == 0 {
+		return true
+	}
+
+	for _, t := range b.Transformers {
+		if err := t.Transform(m); err != nil {
+			b.Metrics.Incr("errors.transform")
+			b.Log.Error("transforming %s: %s", m.ID, err)
+			return false
+		}
+	}
+
+	// the context was created for the filter and ratelimiter
+	m.ctx = nil
+	return true
+}
+
 // rateExceeded returns true if the given message
 // rate was exceeded. The method returns false
 // if ratelimit was not configured or exceeded.
 func (b *Broadcast) rateExceeded(msg *Message) bool {
 	if b.Ratelimiter != nil {
-		k := gjson.Get(string(msg.JSON), b.RatelimitKey).String()
+		k := msg.Context().Get(b.RatelimitKey).String()
 		return b.Ratelimiter.Exceeded(k)
 	}
 
@@ -190,7 +645,8 @@ func NewMessage(id, contents string) (*Message, error) {
 
 	m := new(Message)
 	m.ID = nsqId
-	err := json.Unmarshal([]byte(contents), &m.JSON)
+	m.Body = []byte(contents)
+	err := json.Unmarshal(m.Body, &m.JSON)
 	if err != nil {
 		return nil, err
 	}
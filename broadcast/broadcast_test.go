@@ -1,7 +1,12 @@
 package broadcast
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -19,6 +24,71 @@ import (
 func Benchmark1handler(b *testing.B)  { benchmarkBroadcast(1, b) }
 func Benchmark2Handlers(b *testing.B) { benchmarkBroadcast(2, b) }
 
+func Benchmark1handlerLarge(b *testing.B)  { benchmarkBroadcastLarge(1, b) }
+func Benchmark2HandlersLarge(b *testing.B) { benchmarkBroadcastLarge(2, b) }
+
+// benchmarkBroadcastLarge measures the throughput of messages of 64kB,
+// without comparing them to an expected message like benchmarkBroadcast.
+func benchmarkBroadcastLarge(n int, b *testing.B) {
+	pool := &mockRedisPool{}
+	pool.On("Get").Return(mocks.NewNoOpRedisConn())
+
+	broadcast := New(&Options{
+		Redis:        pool,
+		Metrics:      statsd.NewClient(ioutil.Discard),
+		Log:          log.Log,
+		Ratelimiter:  ratelimit.New(10, 500),
+		RatelimitKey: "projectId",
+	})
+
+	for i := 0; i < n; i++ {
+		broadcast.Add(&replyHandler{cmd: "LPUSH"})
+	}
+
+	body := largeMessage(64 << 10)
+	nsqMsg := nsq.NewMessage(newNSQMessageId("nsq__message__id"), body)
+
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		broadcast.HandleMessage(nsqMsg)
+	}
+}
+
+func BenchmarkValidJSON(b *testing.B) {
+	body := largeMessage(64 << 10)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		validJSON(body)
+	}
+}
+
+func BenchmarkUnmarshalJSON(b *testing.B) {
+	body := largeMessage(64 << 10)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		var doc json.RawMessage
+		json.Unmarshal(body, &doc)
+	}
+}
+
+// largeMessage returns a JSON document of about size bytes.
+func largeMessage(size int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"projectId":"gy2d","properties":{`)
+	for i := 0; buf.Len() < size; i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, `"key%d":{"name":"value \"%d\"","n":%d.5e3,"ok":true,"tags":["a","b",null]}`, i, i, i)
+	}
+	buf.WriteString(`}}`)
+	return buf.Bytes()
+}
+
 func benchmarkBroadcast(n int, b *testing.B) {
 	pool := &mockRedisPool{}
 	pool.On("Get").Return(mocks.NewNoOpRedisConn())
@@ -31,10 +101,16 @@ func benchmarkBroadcast(n int, b *testing.B) {
 		RatelimitKey: "projectId",
 	})
 
+	nsqMsg := nsq.NewMessage(newNSQMessageId("nsq__message__id"), []byte(`{"projectId":"gy2d"}`))
 	expectedMessage, err := NewMessage("nsq__message__id", `{"projectId":"gy2d"}`)
 	if err != nil {
 		b.Error(err)
 	}
+	expectedMessage.Timestamp = time.Unix(0, nsqMsg.Timestamp)
+	receivedAt, restore := received()
+	defer restore()
+	expectedMessage.ReceivedAt = receivedAt
+	expectedMessage.Context().Get("projectId") // cached by the ratelimiter
 
 	for i := 0; i < n; i++ {
 		h := &mockHandler{}
@@ -42,8 +118,7 @@ func benchmarkBroadcast(n int, b *testing.B) {
 		broadcast.Add(h)
 	}
 
-	nsqMsg := nsq.NewMessage(newNSQMessageId("nsq__message__id"), []byte(`{"projectId":"gy2d"}`))
-
+	b.ReportAllocs()
 	for n := 0; n < b.N; n++ {
 		broadcast.HandleMessage(nsqMsg)
 	}
@@ -67,8 +142,14 @@ func TestBroadcast(t *testing.T) {
 		RatelimitKey: "projectId",
 	})
 
+	nsqMsg := nsq.NewMessage(newNSQMessageId("nsq__message__id"), []byte(`{"projectId":"gy2d"}`))
 	expectedMessage, err := NewMessage("nsq__message__id", `{"projectId":"gy2d"}`)
 	assert.Equal(t, nil, err)
+	expectedMessage.Timestamp = time.Unix(0, nsqMsg.Timestamp)
+	receivedAt, restore := received()
+	defer restore()
+	expectedMessage.ReceivedAt = receivedAt
+	expectedMessage.Context().Get("projectId") // cached by the ratelimiter
 
 	h1 := &mockHandler{}
 	h1.On("Handle", mock.Anything, expectedMessage).Times(1).Return(nil)
@@ -78,19 +159,62 @@ func TestBroadcast(t *testing.T) {
 	b.Add(h1)
 	b.Add(h2)
 
-	nsqMsg := nsq.NewMessage(newNSQMessageId("nsq__message__id"), []byte(`{"projectId":"gy2d"}`))
 	b.HandleMessage(nsqMsg)
 
 	h1.AssertExpectations(t)
 	h2.AssertExpectations(t)
 }
 
+func TestBroadcastMessageMetadata(t *testing.T) {
+	b := New(&Options{
+		Topic:   "events",
+		Channel: "nsq_to_redis",
+		Redis:   getMockPool(),
+		Metrics: statsd.NewClient(ioutil.Discard),
+		Log:     log.Log,
+	})
+
+	var m *Message
+	h := &mockHandler{}
+	h.On("Handle", mock.Anything, mock.Anything).Return(func(c Conn, msg *Message) error {
+		m = msg
+		return nil
+	})
+	b.Add(h)
+
+	nsqMsg := newNSQMessage(nil)
+	nsqMsg.Attempts = 3
+	nsqMsg.NSQDAddress = "127.0.0.1:4150"
+	nsqMsg.Timestamp = time.Date(2017, 4, 14, 21, 49, 19, 0, time.UTC).UnixNano()
+	receivedAt, restore := received()
+	defer restore()
+	assert.Equal(t, nil, b.HandleMessage(nsqMsg))
+	assert.Equal(t, receivedAt, m.ReceivedAt)
+
+	ctx := m.Context()
+	assert.Equal(t, `{"projectId":"gy2d"}`, string(ctx.JSON))
+	assert.Equal(t, map[string]string{
+		"topic":     "events",
+		"channel":   "nsq_to_redis",
+		"id":        "nsq__message__id",
+		"attempts":  "3",
+		"nsqd":      "127.0.0.1:4150",
+		"timestamp": "2017-04-14T21:49:19Z",
+	}, ctx.Vars)
+}
+
 func TestBroadcastInvalidFlushInterval(t *testing.T) {
 	assert.Panic(t, "FlushInterval must not be a negative duration", func() {
 		New(&Options{FlushInterval: -1 * time.Hour})
 	})
 }
 
+func TestBroadcastAtomicWithPipelines(t *testing.T) {
+	assert.Panic(t, "Atomic must not be used with several Pipelines", func() {
+		New(&Options{FlushInterval: time.Second, Pipelines: 2, Atomic: true})
+	})
+}
+
 func TestBroadcastWithoutFlushInterval(t *testing.T) {
 	pool := getMockPool()
 	broadcast := New(&Options{
@@ -140,6 +264,529 @@ func TestBroadcastWithFlushIntervalStop(t *testing.T) {
 	assert.Equal(t, 1, int(atomic.LoadUint64(&mockConn.Flushes)))
 }
 
+func TestBroadcastWithFlushMaxCommands(t *testing.T) {
+	pool := getMockPool()
+	broadcast := New(&Options{
+		Redis:            pool,
+		Metrics:          statsd.NewClient(ioutil.Discard),
+		Log:              log.Log,
+		FlushInterval:    10 * time.Second,
+		FlushMaxCommands: 2,
+	})
+	broadcast.Add(newPublishHandler())
+
+	mockConn := pool.Get().(*mocks.NoOpRedisConn)
+	nsqMsg := nsq.NewMessage(newNSQMessageId("nsq__message__id"), []byte(`{"projectId":"gy2d"}`))
+	broadcast.HandleMessage(nsqMsg)
+	assert.Equal(t, 0, int(atomic.LoadUint64(&mockConn.Flushes)))
+	broadcast.HandleMessage(nsqMsg)
+	assert.Equal(t, 1, int(atomic.LoadUint64(&mockConn.Flushes)))
+}
+
+func TestBroadcastWithFlushMaxBytes(t *testing.T) {
+	pool := getMockPool()
+	broadcast := New(&Options{
+		Redis:         pool,
+		Metrics:       statsd.NewClient(ioutil.Discard),
+		Log:           log.Log,
+		FlushInterval: 10 * time.Second,
+		FlushMaxBytes: 50,
+	})
+	broadcast.Add(newPublishHandler())
+
+	// Each PUBLISH buffers 34 bytes.
+	mockConn := pool.Get().(*mocks.NoOpRedisConn)
+	nsqMsg := nsq.NewMessage(newNSQMessageId("nsq__message__id"), []byte(`{"projectId":"gy2d"}`))
+	broadcast.HandleMessage(nsqMsg)
+	assert.Equal(t, 0, int(atomic.LoadUint64(&mockConn.Flushes)))
+	broadcast.HandleMessage(nsqMsg)
+	assert.Equal(t, 1, int(atomic.LoadUint64(&mockConn.Flushes)))
+}
+
+func TestBroadcastWithPipelinesStop(t *testing.T) {
+	pool := &mockRedisPool{}
+	conns := make([]*mocks.NoOpRedisConn, 4)
+	for i := range conns {
+		conns[i] = &mocks.NoOpRedisConn{}
+		pool.On("Get").Return(conns[i]).Once()
+	}
+
+	broadcast := New(&Options{
+		Redis:         pool,
+		Metrics:       statsd.NewClient(ioutil.Discard),
+		Log:           log.Log,
+		FlushInterval: 10 * time.Second,
+		Pipelines:     4,
+	})
+	broadcast.Add(newPublishHandler())
+
+	sendMessages(broadcast)
+	broadcast.Stop()
+	<-broadcast.Done
+
+	pool.AssertExpectations(t)
+	for _, c := range conns {
+		assert.Equal(t, 1, int(atomic.LoadUint64(&c.Flushes)))
+	}
+}
+
+func TestBroadcastPipelineReconnect(t *testing.T) {
+	healthy := &mocks.NoOpRedisConn{}
+	pool := &mockRedisPool{}
+	pool.On("Get").Return(&brokenConn{}).Once()
+	pool.On("Get").Return(healthy).Once()
+
+	broadcast := New(&Options{
+		Redis:            pool,
+		Metrics:          statsd.NewClient(ioutil.Discard),
+		Log:              log.Log,
+		FlushInterval:    10 * time.Second,
+		FlushMaxCommands: 1,
+	})
+	broadcast.Add(newPublishHandler())
+
+	err := broadcast.HandleMessage(newNSQMessage(nil))
+	assert.Equal(t, errBroken, err)
+
+	err = broadcast.HandleMessage(newNSQMessage(nil))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, int(atomic.LoadUint64(&healthy.Flushes)))
+	pool.AssertExpectations(t)
+}
+
+func TestBroadcastAtomic(t *testing.T) {
+	c := &replyConn{exec: []interface{}{int64(1), int64(1)}}
+	broadcast := newAtomicBroadcast(c, 0)
+
+	err := broadcast.HandleMessage(newNSQMessage(nil))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"MULTI", "PUBLISH", "PUBLISH", "EXEC"}, c.commands)
+}
+
+func TestBroadcastAtomicAborted(t *testing.T) {
+	c := &replyConn{exec: nil}
+	broadcast := newAtomicBroadcast(c, 0)
+
+	err := broadcast.HandleMessage(newNSQMessage(nil))
+	assert.Equal(t, ErrAborted, err)
+}
+
+func TestBroadcastAtomicCommandError(t *testing.T) {
+	wrongType := redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+	c := &replyConn{exec: []interface{}{int64(1), wrongType}}
+	broadcast := newAtomicBroadcast(c, 0)
+
+	err := broadcast.HandleMessage(newNSQMessage(nil))
+	assert.Equal(t, wrongType, err)
+}
+
+func TestBroadcastAtomicWithFlushInterval(t *testing.T) {
+	c := &replyConn{exec: []interface{}{int64(1), int64(1)}}
+	broadcast := newAtomicBroadcast(c, 10*time.Second)
+
+	d := &mockDelegate{}
+	assert.Equal(t, nil, broadcast.HandleMessage(newNSQMessage(d)))
+	assert.Equal(t, nil, broadcast.HandleMessage(newNSQMessage(d)))
+	assert.Equal(t, 0, d.finished)
+
+	broadcast.Stop()
+	<-broadcast.Done
+	assert.Equal(t, 2, d.finished)
+	assert.Equal(t, 0, d.requeued)
+	assert.Equal(t, []string{
+		"MULTI", "PUBLISH", "PUBLISH", "EXEC",
+		"MULTI", "PUBLISH", "PUBLISH", "EXEC",
+	}, c.commands)
+}
+
+func TestBroadcastAtomicWithFlushIntervalAborted(t *testing.T) {
+	c := &replyConn{exec: nil}
+	broadcast := newAtomicBroadcast(c, 10*time.Second)
+
+	d := &mockDelegate{}
+	assert.Equal(t, nil, broadcast.HandleMessage(newNSQMessage(d)))
+
+	broadcast.Stop()
+	<-broadcast.Done
+	assert.Equal(t, 0, d.finished)
+	assert.Equal(t, 1, d.requeued)
+}
+
+func TestBroadcastAddTo(t *testing.T) {
+	c1, c2 := &replyConn{}, &replyConn{}
+	p1, p2 := &mockRedisPool{}, &mockRedisPool{}
+	p1.On("Get").Return(c1)
+	p2.On("Get").Return(c2)
+
+	broadcast := New(&Options{
+		Redis:   p1,
+		Metrics: statsd.NewClient(ioutil.Discard),
+		Log:     log.Log,
+	})
+	broadcast.Add(newPublishHandler())
+	broadcast.AddTo(p2, newPublishHandler())
+	broadcast.AddTo(p2, newPublishHandler())
+
+	err := broadcast.HandleMessage(newNSQMessage(nil))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"PUBLISH"}, c1.commands)
+	assert.Equal(t, []string{"PUBLISH", "PUBLISH"}, c2.commands)
+}
+
+func TestBroadcastFilter(t *testing.T) {
+	c := &replyConn{}
+	pool := &mockRedisPool{}
+	pool.On("Get").Return(c)
+
+	broadcast := New(&Options{
+		Redis:   pool,
+		Metrics: statsd.NewClient(ioutil.Discard),
+		Log:     log.Log,
+		Filter: predicate(func(m *Message) bool {
+			return m.Context().Get("projectId").String() == "gy2d"
+		}),
+	})
+	broadcast.Add(newPublishHandler())
+
+	err := broadcast.HandleMessage(newNSQMessage(nil))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"PUBLISH"}, c.commands)
+
+	msg := nsq.NewMessage(newNSQMessageId("nsq__message__id"), []byte(`{"projectId":"other"}`))
+	err = broadcast.HandleMessage(msg)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"PUBLISH"}, c.commands)
+}
+
+func TestBroadcastFiltered(t *testing.T) {
+	c := &replyConn{}
+	pool := &mockRedisPool{}
+	pool.On("Get").Return(c)
+
+	broadcast := New(&Options{
+		Redis:   pool,
+		Metrics: statsd.NewClient(ioutil.Discard),
+		Log:     log.Log,
+	})
+	broadcast.Add(newPublishHandler())
+	broadcast.Add(broadcast.Filtered("none", predicate(func(*Message) bool {
+		return false
+	}), newPublishHandler()))
+
+	err := broadcast.HandleMessage(newNSQMessage(nil))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"PUBLISH"}, c.commands)
+}
+
+func TestBroadcastTransformers(t *testing.T) {
+	c := &replyConn{}
+	pool := &mockRedisPool{}
+	pool.On("Get").Return(c)
+
+	upper := transformer(func(m *Message) error {
+		m.JSON = []byte(strings.ToUpper(string(m.JSON)))
+		return nil
+	})
+
+	broadcast := New(&Options{
+		Redis:   pool,
+		Metrics: statsd.NewClient(ioutil.Discard),
+		Log:     log.Log,
+		Filter: predicate(func(m *Message) bool {
+			return m.Context().Get("projectId").Exists()
+		}),
+		Transformers: []Transformer{upper},
+	})
+
+	var contexts []string
+	h := &mockHandler{}
+	h.On("Handle", mock.Anything, mock.Anything).Return(func(c Conn, m *Message) error {
+		contexts = append(contexts, string(m.Context().JSON))
+		return nil
+	})
+	broadcast.Add(h)
+
+	assert.Equal(t, nil, broadcast.HandleMessage(newNSQMessage(nil)))
+	assert.Equal(t, []string{`{"PROJECTID":"GY2D"}`}, contexts)
+}
+
+func TestBroadcastTransformersError(t *testing.T) {
+	c := &replyConn{}
+	pool := &mockRedisPool{}
+	pool.On("Get").Return(c)
+
+	broadcast := New(&Options{
+		Redis:   pool,
+		Metrics: statsd.NewClient(ioutil.Discard),
+		Log:     log.Log,
+		Transformers: []Transformer{transformer(func(m *Message) error {
+			return errors.New("boom")
+		})},
+	})
+	broadcast.Add(newPublishHandler())
+
+	assert.Equal(t, nil, broadcast.HandleMessage(newNSQMessage(nil)))
+	assert.Equal(t, []string(nil), c.commands)
+}
+
+func TestBroadcastDecoder(t *testing.T) {
+	c := &replyConn{}
+	pool := &mockRedisPool{}
+	pool.On("Get").Return(c)
+
+	broadcast := New(&Options{
+		Redis:   pool,
+		Metrics: statsd.NewClient(ioutil.Discard),
+		Log:     log.Log,
+		Decoder: decoder(func(body []byte) (json.RawMessage, error) {
+			if string(body) == "raw" {
+				return nil, nil
+			}
+			return nil, errors.New("invalid body")
+		}),
+	})
+
+	var messages []*Message
+	h := &mockHandler{}
+	h.On("Handle", mock.Anything, mock.Anything).Return(func(c Conn, m *Message) error {
+		messages = append(messages, m)
+		return nil
+	})
+	broadcast.Add(h)
+
+	msg := nsq.NewMessage(newNSQMessageId("nsq__message__id"), []byte("raw"))
+	assert.Equal(t, nil, broadcast.HandleMessage(msg))
+	msg = nsq.NewMessage(newNSQMessageId("nsq__message__id"), []byte("invalid"))
+	assert.Equal(t, nil, broadcast.HandleMessage(msg))
+
+	assert.Equal(t, 1, len(messages))
+	assert.Equal(t, "raw", string(messages[0].Body))
+	assert.Equal(t, 0, len(messages[0].JSON))
+	assert.Equal(t, false, messages[0].Context().Get("projectId").Exists())
+	assert.Equal(t, "nsq__message__id", messages[0].Context().Vars["id"])
+}
+
+func TestBroadcastMaxMessageBytes(t *testing.T) {
+	c := &replyConn{}
+	pool := &mockRedisPool{}
+	pool.On("Get").Return(c)
+
+	small := nsq.NewMessage(newNSQMessageId("nsq__message__id"), []byte(`{"a":"b"}`))
+	large := nsq.NewMessage(newNSQMessageId("nsq__message__id"), []byte(`{"a":"bbbbbbbbbbbbbbbbbbbb"}`))
+
+	// skip
+	broadcast := New(&Options{
+		Redis:           pool,
+		Metrics:         statsd.NewClient(ioutil.Discard),
+		Log:             log.Log,
+		MaxMessageBytes: 16,
+	})
+
+	var handled []string
+	h := &mockHandler{}
+	h.On("Handle", mock.Anything, mock.Anything).Return(func(c Conn, m *Message) error {
+		handled = append(handled, string(m.JSON))
+		return nil
+	})
+	broadcast.Add(h)
+
+	assert.Equal(t, nil, broadcast.HandleMessage(small))
+	assert.Equal(t, nil, broadcast.HandleMessage(large))
+	assert.Equal(t, []string{`{"a":"b"}`}, handled)
+
+	// truncate
+	broadcast.Truncate = transformer(func(m *Message) error {
+		m.JSON = []byte(`{"a":"bbb"}`)
+		return nil
+	})
+	assert.Equal(t, nil, broadcast.HandleMessage(large))
+	assert.Equal(t, []string{`{"a":"b"}`, `{"a":"bbb"}`}, handled)
+
+	// still too large
+	broadcast.Truncate = transformer(func(m *Message) error { return nil })
+	assert.Equal(t, nil, broadcast.HandleMessage(large))
+	assert.Equal(t, 2, len(handled))
+
+	// dead letter
+	dead := &replyHandler{cmd: "LPUSH"}
+	broadcast.DeadLetter = dead
+	assert.Equal(t, nil, broadcast.HandleMessage(large))
+	assert.Equal(t, nil, broadcast.HandleMessage(small))
+	assert.Equal(t, 1, dead.handled)
+	assert.Equal(t, 3, len(handled))
+}
+
+func TestBroadcastRoute(t *testing.T) {
+	c1, c2 := &replyConn{}, &replyConn{}
+	p1, p2 := &mockRedisPool{}, &mockRedisPool{}
+	p1.On("Get").Return(c1)
+	p2.On("Get").Return(c2)
+
+	broadcast := New(&Options{
+		Redis:   p1,
+		Metrics: statsd.NewClient(ioutil.Discard),
+		Log:     log.Log,
+	})
+
+	isType := func(typ string) Predicate {
+		return predicate(func(m *Message) bool {
+			return m.Context().Get("type").String() == typ
+		})
+	}
+
+	identify := &replyHandler{cmd: "HSET"}
+	track := &replyHandler{cmd: "LPUSH"}
+	all := &replyHandler{cmd: "PUBLISH"}
+	broadcast.Route("identify", isType("identify"), identify)
+	broadcast.RouteTo(p2, "track", isType("track"), track)
+	broadcast.Route("all", nil, all)
+
+	for _, body := range []string{`{"type":"identify"}`, `{"type":"track"}`, `{"type":"page"}`} {
+		msg := nsq.NewMessage(newNSQMessageId("nsq__message__id"), []byte(body))
+		assert.Equal(t, nil, broadcast.HandleMessage(msg))
+	}
+
+	assert.Equal(t, []string{"HSET", "PUBLISH", "PUBLISH", "PUBLISH"}, c1.commands)
+	assert.Equal(t, []string{"LPUSH"}, c2.commands)
+	assert.Equal(t, 1, identify.handled)
+	assert.Equal(t, 1, track.handled)
+	assert.Equal(t, 3, all.handled)
+}
+
+func TestBroadcastRouteAny(t *testing.T) {
+	c := &replyConn{}
+	p := &mockRedisPool{}
+	p.On("Get").Return(c)
+
+	broadcast := New(&Options{
+		Redis:   p,
+		Metrics: statsd.NewClient(ioutil.Discard),
+		Log:     log.Log,
+	})
+
+	isType := func(typ string) Predicate {
+		return predicate(func(m *Message) bool {
+			return m.Context().Get("type").String() == typ
+		})
+	}
+
+	list := &replyHandler{cmd: "LPUSH"}
+	all := &replyHandler{cmd: "PUBLISH"}
+	broadcast.Route("list", Any(isType("track"), isType("page")), list)
+	broadcast.Route("all", Any(isType("track"), nil), all)
+
+	for _, body := range []string{`{"type":"identify"}`, `{"type":"track"}`, `{"type":"page"}`} {
+		msg := nsq.NewMessage(newNSQMessageId("nsq__message__id"), []byte(body))
+		assert.Equal(t, nil, broadcast.HandleMessage(msg))
+	}
+
+	assert.Equal(t, 2, list.handled)
+	assert.Equal(t, 3, all.handled)
+}
+
+func TestBroadcastAtomicWithFlushIntervalAddTo(t *testing.T) {
+	c1 := &replyConn{exec: []interface{}{int64(1)}}
+	c2 := &replyConn{exec: nil}
+	p1, p2 := &mockRedisPool{}, &mockRedisPool{}
+	p1.On("Get").Return(c1)
+	p2.On("Get").Return(c2)
+
+	broadcast := New(&Options{
+		Redis:         p1,
+		Metrics:       statsd.NewClient(ioutil.Discard),
+		Log:           log.Log,
+		FlushInterval: 10 * time.Second,
+		Atomic:        true,
+	})
+	broadcast.Add(newPublishHandler())
+	broadcast.AddTo(p2, newPublishHandler())
+
+	d := &mockDelegate{}
+	assert.Equal(t, nil, broadcast.HandleMessage(newNSQMessage(d)))
+
+	broadcast.Stop()
+	<-broadcast.Done
+	assert.Equal(t, 0, d.finished)
+	assert.Equal(t, 1, d.requeued)
+}
+
+func TestValidJSON(t *testing.T) {
+	for _, s := range []string{
+		`{}`, `[]`, `""`, `0`, `-0.5e+3`, `1E9`, `true`, `false`, `null`,
+		` {"a" : [1, "b", {"c": null}] } `, `"\u00e9\n\"\/"`, "\"\xff\"", "\n[1]\n",
+		``, ` `, `{`, `{"a"}`, `{"a":1,}`, `[1,]`, `[1 2]`, `01`, `-`, `1.`, `.5`, `1e`,
+		`"a`, "\"\t\"", `"\x"`, `"\u12"`, `tru`, `nul`, `{} {}`, `{a:1}`, `'a'`,
+	} {
+		doc, ok := validJSON([]byte(s))
+		var raw json.RawMessage
+		err := json.Unmarshal([]byte(s), &raw)
+		assert.Equal(t, err == nil, ok, s)
+		assert.Equal(t, string(raw), string(doc), s)
+	}
+
+	deep := strings.Repeat("[", maxDepth) + strings.Repeat("]", maxDepth)
+	_, ok := validJSON([]byte(deep))
+	assert.Equal(t, true, ok)
+
+	_, ok = validJSON([]byte("[" + deep + "]"))
+	assert.Equal(t, false, ok)
+}
+
+func TestBroadcastInvalidJSON(t *testing.T) {
+	broadcast := New(&Options{
+		Redis:   getMockPool(),
+		Metrics: statsd.NewClient(ioutil.Discard),
+		Log:     log.Log,
+	})
+
+	h := &replyHandler{}
+	broadcast.Add(h)
+
+	msg := nsq.NewMessage(newNSQMessageId("nsq__message__id"), []byte(`{"projectId":`))
+	assert.Equal(t, nil, broadcast.HandleMessage(msg))
+	assert.Equal(t, 0, h.handled)
+}
+
+func TestShard(t *testing.T) {
+	for _, key := range []string{"", "a", "events:gy2d", "events:0ab7"} {
+		i := shard([]byte(key), 4)
+		assert.T(t, i >= 0 && i < 4)
+		assert.Equal(t, i, shard([]byte(key), 4))
+		assert.Equal(t, 0, shard([]byte(key), 1))
+	}
+}
+
+func newAtomicBroadcast(c redis.Conn, flushInterval time.Duration) *Broadcast {
+	pool := &mockRedisPool{}
+	pool.On("Get").Return(c)
+
+	broadcast := New(&Options{
+		Redis:         pool,
+		Metrics:       statsd.NewClient(ioutil.Discard),
+		Log:           log.Log,
+		FlushInterval: flushInterval,
+		Atomic:        true,
+	})
+	broadcast.Add(newPublishHandler())
+	broadcast.Add(newPublishHandler())
+	return broadcast
+}
+
+// received stubs the time messages are received at, until the
+// returned function restores it.
+func received() (time.Time, func()) {
+	t := time.Date(2017, 4, 14, 21, 49, 20, 0, time.UTC)
+	old := now
+	now = func() time.Time { return t }
+	return t, func() { now = old }
+}
+
+func newNSQMessage(d nsq.MessageDelegate) *nsq.Message {
+	msg := nsq.NewMessage(newNSQMessageId("nsq__message__id"), []byte(`{"projectId":"gy2d"}`))
+	msg.Delegate = d
+	return msg
+}
+
 func getMockPool() RedisPool {
 	pool := &mockRedisPool{}
 	pool.On("Get").Return(mocks.NewNoOpRedisConn())
@@ -158,6 +805,42 @@ func newNSQMessageId(id string) nsq.MessageID {
 	return nsqId
 }
 
+// newPublishHandler returns a handler that
+// publishes every message to "channel".
+func newPublishHandler() Handler {
+	h := &mockHandler{}
+	h.On("Handle", mock.Anything, mock.Anything).Return(func(c Conn, m *Message) error {
+		return c.Send("PUBLISH", "channel", []byte(m.JSON))
+	})
+	return h
+}
+
+// replyHandler sends cmd for every message it handles.
+type replyHandler struct {
+	cmd     string
+	handled int
+}
+
+func (h *replyHandler) Handle(c Conn, m *Message) error {
+	h.handled++
+	return c.Send(h.cmd, "key", []byte(m.JSON))
+}
+
+// decoder is a function implementing Decoder.
+type decoder func([]byte) (json.RawMessage, error)
+
+func (d decoder) Decode(body []byte) (json.RawMessage, error) { return d(body) }
+
+// transformer is a function implementing Transformer.
+type transformer func(*Message) error
+
+func (t transformer) Transform(m *Message) error { return t(m) }
+
+// predicate is a function implementing Predicate.
+type predicate func(*Message) bool
+
+func (p predicate) Match(m *Message) bool { return p(m) }
+
 type mockHandler struct {
 	mock.Mock
 }
@@ -176,6 +859,49 @@ func (_m *mockHandler) Handle(_a0 Conn, _a1 *Message) error {
 	return r0
 }
 
+// replyConn records the commands sent and replies
+// with exec to EXEC and "OK" to all other commands.
+type replyConn struct {
+	mocks.NoOpRedisConn
+	commands []string
+	pending  []string
+	exec     interface{}
+}
+
+func (c *replyConn) Send(cmd string, args ...interface{}) error {
+	c.commands = append(c.commands, cmd)
+	c.pending = append(c.pending, cmd)
+	return nil
+}
+
+func (c *replyConn) Receive() (interface{}, error) {
+	cmd := c.pending[0]
+	c.pending = c.pending[1:]
+	if cmd == "EXEC" {
+		return c.exec, nil
+	}
+	return "OK", nil
+}
+
+var errBroken = errors.New("i/o timeout")
+
+// brokenConn is a connection that failed.
+type brokenConn struct {
+	mocks.NoOpRedisConn
+}
+
+func (c *brokenConn) Flush() error { return errBroken }
+func (c *brokenConn) Err() error   { return errBroken }
+
+type mockDelegate struct {
+	finished int
+	requeued int
+}
+
+func (d *mockDelegate) OnFinish(*nsq.Message)                       { d.finished++ }
+func (d *mockDelegate) OnRequeue(*nsq.Message, time.Duration, bool) { d.requeued++ }
+func (d *mockDelegate) OnTouch(*nsq.Message)                        {}
+
 type mockRedisPool struct {
 	mock.Mock
 }
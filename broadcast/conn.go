@@ -1,6 +1,14 @@
 package broadcast
 
-import "github.com/garyburd/redigo/redis"
+import (
+	"errors"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ErrAborted is returned when a transaction was
+// discarded and EXEC replied with nil.
+var ErrAborted = errors.New("transaction aborted")
 
 type Conn interface {
 	Send(cmd string, args ...interface{}) error
@@ -12,6 +20,14 @@ type Conn interface {
 type conn struct {
 	conn    redis.Conn
 	pending int
+	size    int
+	txs     []tx
+}
+
+// tx is a transaction awaiting its EXEC reply.
+type tx struct {
+	reply int
+	done  func(error)
 }
 
 // NewConn returns a new Conn.
@@ -23,25 +39,120 @@ func NewConn(c redis.Conn) Conn {
 func (c *conn) Send(cmd string, args ...interface{}) error {
 	err := c.conn.Send(cmd, args...)
 	c.pending++
+	c.size += len(cmd)
+	for _, arg := range args {
+		c.size += argSize(arg)
+	}
 	return err
 }
 
 // Flush will flush the redis buffers
 // and receive all responses from redis.
+// Error replies do not stop the remaining
+// replies from being received, the first
+// one is returned.
 func (c *conn) Flush() error {
 	err := c.conn.Flush()
 	if err != nil {
+		c.reset(err)
 		return err
 	}
 
+	var first error
+	txs := c.txs
 	for i := 0; i < c.pending; i++ {
-		_, err := c.conn.Receive()
-		if err != nil {
+		reply, err := c.conn.Receive()
+		if _, ok := err.(redis.Error); err != nil && !ok {
+			c.txs = txs
+			c.reset(err)
 			return err
 		}
+
+		if len(txs) > 0 && txs[0].reply == i {
+			txs[0].done(execError(reply, err))
+			txs = txs[1:]
+		}
+
+		if first == nil {
+			first = err
+		}
+	}
+
+	c.txs = txs
+	c.reset(nil)
+	return first
+}
+
+// exec sends EXEC and calls done with the
+// result of the transaction once flushed.
+func (c *conn) exec(done func(error)) error {
+	err := c.Send("EXEC")
+	if err != nil {
+		return err
+	}
+
+	c.txs = append(c.txs, tx{reply: c.pending - 1, done: done})
+	return nil
+}
+
+// reset discards pending replies, transactions
+// that did not complete are failed with err.
+func (c *conn) reset(err error) {
+	for _, t := range c.txs {
+		t.done(err)
 	}
 
 	c.pending = 0
+	c.size = 0
+	c.txs = nil
+}
+
+// execError returns the error of an EXEC reply,
+// the first failed command fails the transaction.
+func execError(reply interface{}, err error) error {
+	if err != nil {
+		return err
+	}
+
+	if reply == nil {
+		return ErrAborted
+	}
+
+	if replies, ok := reply.([]interface{}); ok {
+		for _, r := range replies {
+			if err, ok := r.(redis.Error); ok {
+				return err
+			}
+		}
+	}
 
 	return nil
 }
+
+// exceeds returns true if the buffered commands reach
+// either the given number of commands or bytes.
+// A limit <= 0 is ignored.
+func (c *conn) exceeds(commands, bytes int) bool {
+	if commands > 0 && c.pending >= commands {
+		return true
+	}
+
+	if bytes > 0 && c.size >= bytes {
+		return true
+	}
+
+	return false
+}
+
+// argSize approximates the number of bytes
+// an argument occupies in the redis buffer.
+func argSize(arg interface{}) int {
+	switch v := arg.(type) {
+	case string:
+		return len(v)
+	case []byte:
+		return len(v)
+	default:
+		return 8
+	}
+}
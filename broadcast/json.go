@@ -0,0 +1,223 @@
+package broadcast
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+var ErrInvalidJSON = errors.New("invalid json")
+
+// maxDepth is the maximum nesting of objects and arrays.
+const maxDepth = 10000
+
+// validJSON returns the JSON value in data without surrounding
+// whitespace, or false if data isn't a single valid JSON value.
+// Unlike json.Unmarshal it scans data once and doesn't copy it.
+func validJSON(data []byte) (json.RawMessage, bool) {
+	s := &scanner{data: data}
+	s.space()
+	start := s.pos
+	if !s.value(0) {
+		return nil, false
+	}
+	end := s.pos
+	s.space()
+	if s.pos != len(data) {
+		return nil, false
+	}
+	return data[start:end], true
+}
+
+// scanner is a JSON syntax checker.
+type scanner struct {
+	data []byte
+	pos  int
+}
+
+func (s *scanner) space() {
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case ' ', '\t', '\r', '\n':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+// next returns the next byte, or 0 at the end of data.
+func (s *scanner) next() byte {
+	if s.pos < len(s.data) {
+		return s.data[s.pos]
+	}
+	return 0
+}
+
+// value scans a value nested in depth objects and arrays.
+func (s *scanner) value(depth int) bool {
+	switch c := s.next(); {
+	case c == '{':
+		return depth < maxDepth && s.object(depth+1)
+	case c == '[':
+		return depth < maxDepth && s.array(depth+1)
+	case c == '"':
+		return s.str()
+	case c == '-' || c >= '0' && c <= '9':
+		return s.number()
+	case c == 't':
+		return s.literal("true")
+	case c == 'f':
+		return s.literal("false")
+	case c == 'n':
+		return s.literal("null")
+	default:
+		return false
+	}
+}
+
+func (s *scanner) object(depth int) bool {
+	s.pos++
+	s.space()
+	if s.next() == '}' {
+		s.pos++
+		return true
+	}
+
+	for {
+		if s.next() != '"' || !s.str() {
+			return false
+		}
+		s.space()
+		if s.next() != ':' {
+			return false
+		}
+		s.pos++
+		s.space()
+		if !s.value(depth) {
+			return false
+		}
+		s.space()
+
+		switch s.next() {
+		case ',':
+			s.pos++
+			s.space()
+		case '}':
+			s.pos++
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+func (s *scanner) array(depth int) bool {
+	s.pos++
+	s.space()
+	if s.next() == ']' {
+		s.pos++
+		return true
+	}
+
+	for {
+		if !s.value(depth) {
+			return false
+		}
+		s.space()
+
+		switch s.next() {
+		case ',':
+			s.pos++
+			s.space()
+		case ']':
+			s.pos++
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// str scans a string, invalid UTF-8 is accepted
+// as json.Unmarshal replaces it.
+func (s *scanner) str() bool {
+	for s.pos++; s.pos < len(s.data); s.pos++ {
+		switch c := s.data[s.pos]; {
+		case c == '"':
+			s.pos++
+			return true
+		case c < 0x20:
+			return false
+		case c == '\\':
+			s.pos++
+			switch s.next() {
+			case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+			case 'u':
+				for i := 0; i < 4; i++ {
+					s.pos++
+					if !hex(s.next()) {
+						return false
+					}
+				}
+			default:
+				return false
+			}
+		}
+	}
+	return false
+}
+
+func (s *scanner) number() bool {
+	if s.next() == '-' {
+		s.pos++
+	}
+
+	switch c := s.next(); {
+	case c == '0':
+		s.pos++
+	case c >= '1' && c <= '9':
+		s.digits()
+	default:
+		return false
+	}
+
+	if s.next() == '.' {
+		s.pos++
+		if !s.digits() {
+			return false
+		}
+	}
+
+	if c := s.next(); c == 'e' || c == 'E' {
+		s.pos++
+		if c := s.next(); c == '+' || c == '-' {
+			s.pos++
+		}
+		if !s.digits() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// digits scans one or more digits.
+func (s *scanner) digits() bool {
+	start := s.pos
+	for c := s.next(); c >= '0' && c <= '9'; c = s.next() {
+		s.pos++
+	}
+	return s.pos > start
+}
+
+func (s *scanner) literal(lit string) bool {
+	if len(s.data)-s.pos < len(lit) || string(s.data[s.pos:s.pos+len(lit)]) != lit {
+		return false
+	}
+	s.pos += len(lit)
+	return true
+}
+
+func hex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
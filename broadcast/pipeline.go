@@ -0,0 +1,69 @@
+package broadcast
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// pipeline is a buffered connection
+// shared by concurrent handlers.
+type pipeline struct {
+	sync.Mutex
+	pool RedisPool
+	conn *conn
+}
+
+// command is a buffered redis command.
+type command struct {
+	name string
+	args []interface{}
+}
+
+// key returns the key the command operates on,
+// by convention its first argument.
+func (c command) key() []byte {
+	if len(c.args) == 0 {
+		return nil
+	}
+
+	switch k := c.args[0].(type) {
+	case string:
+		return []byte(k)
+	case []byte:
+		return k
+	default:
+		return nil
+	}
+}
+
+// batch records the commands handlers issue for a
+// single message so they can be routed to pipelines
+// without holding a lock while handlers run.
+type batch struct {
+	commands []command
+}
+
+// Send records the given command.
+func (b *batch) Send(cmd string, args ...interface{}) error {
+	b.commands = append(b.commands, command{cmd, args})
+	return nil
+}
+
+// Flush is a no-op, batches are flushed by
+// the pipelines they are written to.
+func (b *batch) Flush() error {
+	return nil
+}
+
+// shard returns the index of the pipeline for the given key,
+// commands on the same key always go to the same pipeline
+// which preserves their order.
+func shard(key []byte, n int) int {
+	if n == 1 {
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(n))
+}
@@ -0,0 +1,55 @@
+package broadcast
+
+import (
+	"sync"
+
+	"github.com/bitly/go-nsq"
+)
+
+// target is a redis pool and the handlers writing to it.
+type target struct {
+	pool     RedisPool
+	handlers []Handler
+
+	// Pipelines are used when applying a flush interval
+	pipelines []*pipeline
+}
+
+// pipeline returns the pipeline for the given key.
+func (t *target) pipeline(key []byte) *pipeline {
+	return t.pipelines[shard(key, len(t.pipelines))]
+}
+
+// response finishes a message once all of its transactions
+// succeeded, or requeues it if any of them failed.
+type response struct {
+	sync.Mutex
+	broadcast *Broadcast
+	msg       *nsq.Message
+	pending   int
+	err       error
+}
+
+// done records the result of a transaction.
+func (r *response) done(err error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+
+	r.pending--
+	if r.pending > 0 {
+		return
+	}
+
+	if r.err != nil {
+		r.broadcast.Metrics.Incr("errors.exec")
+		r.broadcast.Log.Error("exec %s: %s", r.msg.ID, r.err)
+		r.msg.Requeue(-1)
+		return
+	}
+
+	r.msg.Finish()
+}
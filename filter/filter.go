@@ -0,0 +1,237 @@
+// Package filter provides expressions matching messages by their contents,
+// such as `type == "track" && properties.revenue > 0`.
+//
+// Operands are gjson paths into the message, reserved variables such as
+// @topic, and string, number, boolean and null literals. They are compared
+// with ==, !=, <, <=, > and >=, or against a list with `in`, for example
+// `event in ["Order Completed", "Signed Up"]`. A path on its own is true
+// when its value is present and not false, null, 0 or "". Expressions are
+// combined with !, && and ||, and grouped with parentheses.
+package filter
+
+import (
+	"time"
+
+	"github.com/segmentio/nsq_to_redis/broadcast"
+	"github.com/segmentio/nsq_to_redis/template"
+	"github.com/tidwall/gjson"
+)
+
+// Expr is a parsed filter expression.
+type Expr struct {
+	src   string
+	root  boolean
+	paths []string
+}
+
+// Parse parses the expression s.
+func Parse(s string) (*Expr, error) {
+	p := &parser{lexer: lexer{src: s}}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind != tEOF {
+		return nil, p.unexpected()
+	}
+
+	return &Expr{src: s, root: root, paths: p.paths}, nil
+}
+
+// Match implements broadcast.Predicate.
+func (e *Expr) Match(m *broadcast.Message) bool {
+	return e.Eval(m.Context())
+}
+
+// Eval evaluates the expression against a context.
+func (e *Expr) Eval(ctx *template.Context) bool {
+	return e.root.eval(ctx)
+}
+
+// Variables returns the paths referenced by the expression in order
+// of appearance, including reserved variables such as "@topic".
+// Each path is only listed once.
+func (e *Expr) Variables() []string {
+	var vars []string
+	seen := make(map[string]struct{})
+	for _, p := range e.paths {
+		if _, ok := seen[p]; !ok {
+			seen[p] = struct{}{}
+			vars = append(vars, p)
+		}
+	}
+	return vars
+}
+
+// String returns the expression as written.
+func (e *Expr) String() string {
+	return e.src
+}
+
+// boolean is a node evaluating to true or false.
+type boolean interface {
+	eval(*template.Context) bool
+}
+
+// operand is a node evaluating to a value.
+type operand interface {
+	value(*template.Context) gjson.Result
+}
+
+type or struct{ left, right boolean }
+
+func (n or) eval(ctx *template.Context) bool {
+	return n.left.eval(ctx) || n.right.eval(ctx)
+}
+
+type and struct{ left, right boolean }
+
+func (n and) eval(ctx *template.Context) bool {
+	return n.left.eval(ctx) && n.right.eval(ctx)
+}
+
+type not struct{ boolean }
+
+func (n not) eval(ctx *template.Context) bool {
+	return !n.boolean.eval(ctx)
+}
+
+// truthy is true if its operand is present
+// and not false, null, 0 or "".
+type truthy struct{ operand }
+
+func (n truthy) eval(ctx *template.Context) bool {
+	r := n.value(ctx)
+	switch r.Type {
+	case gjson.True, gjson.JSON:
+		return true
+	case gjson.Number:
+		return r.Num != 0
+	case gjson.String:
+		return r.Str != ""
+	default:
+		return false
+	}
+}
+
+type compare struct {
+	op          string
+	left, right operand
+}
+
+func (n compare) eval(ctx *template.Context) bool {
+	l, r := n.left.value(ctx), n.right.value(ctx)
+	switch n.op {
+	case "==":
+		return equal(l, r)
+	case "!=":
+		return !equal(l, r)
+	}
+
+	c, ok := order(l, r)
+	if !ok {
+		return false
+	}
+
+	switch n.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+type in struct {
+	operand
+	list []gjson.Result
+}
+
+func (n in) eval(ctx *template.Context) bool {
+	v := n.value(ctx)
+	for _, r := range n.list {
+		if equal(v, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// now returns the current time, @now evaluates to it.
+var now = time.Now
+
+// path looks up a gjson path or a reserved variable.
+type path string
+
+func (p path) value(ctx *template.Context) gjson.Result {
+	switch {
+	case p[0] != '@':
+		return ctx.Get(string(p))
+	case p == "@now":
+		return gjson.Result{Type: gjson.String, Str: now().UTC().Format(time.RFC3339Nano)}
+	}
+
+	s, ok := ctx.Vars[string(p[1:])]
+	if !ok {
+		return gjson.Result{}
+	}
+	return gjson.Result{Type: gjson.String, Str: s}
+}
+
+// literal is a constant value.
+type literal gjson.Result
+
+func (l literal) value(*template.Context) gjson.Result {
+	return gjson.Result(l)
+}
+
+// equal returns true if a and b have the same type and value,
+// a missing value is equal to null.
+func equal(a, b gjson.Result) bool {
+	if a.Type != b.Type {
+		return false
+	}
+
+	switch a.Type {
+	case gjson.String:
+		return a.Str == b.Str
+	case gjson.Number:
+		return a.Num == b.Num
+	case gjson.JSON:
+		return a.Raw == b.Raw
+	default:
+		return true
+	}
+}
+
+// order compares two numbers or two strings.
+func order(a, b gjson.Result) (int, bool) {
+	switch {
+	case a.Type == gjson.Number && b.Type == gjson.Number:
+		switch {
+		case a.Num < b.Num:
+			return -1, true
+		case a.Num > b.Num:
+			return 1, true
+		}
+		return 0, true
+	case a.Type == gjson.String && b.Type == gjson.String:
+		switch {
+		case a.Str < b.Str:
+			return -1, true
+		case a.Str > b.Str:
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,136 @@
+package filter
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/segmentio/nsq_to_redis/broadcast"
+	"github.com/segmentio/nsq_to_redis/template"
+)
+
+const doc = `{
+  "type": "track",
+  "event": "Order Completed",
+  "userId": "",
+  "properties": {"revenue": 19.99, "coupon": null, "items": 0, "tags": ["a"]},
+  "context": {"library": {"name": "analytics.js"}},
+  "anonymous": true,
+  "test": false
+}`
+
+func TestMatch(t *testing.T) {
+	testCases := []struct {
+		expr     string
+		expected bool
+	}{
+		{`type == "track"`, true},
+		{`type == "identify"`, false},
+		{`type != "identify"`, true},
+		{`type == "track" && properties.revenue > 0`, true},
+		{`type == "track" && properties.revenue > 20`, false},
+		{`properties.revenue >= 19.99`, true},
+		{`properties.revenue <= 19.99`, true},
+		{`properties.revenue < 19.99`, false},
+		{`properties.revenue > -1`, true},
+		{`event in ["Order Completed", "Signed Up"]`, true},
+		{`event in ["Signed Up"]`, false},
+		{`event in []`, false},
+		{`!(event in ["Signed Up"])`, true},
+		{`type == "identify" || anonymous`, true},
+		{`type == "identify" || test`, false},
+		{`!test && anonymous == true`, true},
+		{`test == false`, true},
+		{`userId`, false},
+		{`properties.items`, false},
+		{`properties.tags`, true},
+		{`properties.coupon == null`, true},
+		{`properties.missing == null`, true},
+		{`properties.missing`, false},
+		{`properties.revenue == "19.99"`, false},
+		{`properties.revenue > "1"`, false},
+		{`event > "A" && event < "P"`, true},
+		{`context.library.name == "analytics.js"`, true},
+		{`type == "identify" || type == "track" && properties.revenue > 100`, false},
+		{`(type == "identify" || type == "track") && properties.revenue > 10`, true},
+		{`@topic == "events"`, true},
+		{`@channel == "events"`, false},
+		{`@now > "2017"`, true},
+		{`"track" == type`, true},
+		{`event == "Order \"Completed\""`, false},
+	}
+
+	ctx := &template.Context{
+		JSON: []byte(doc),
+		Vars: map[string]string{"topic": "events"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.expr, func(t *testing.T) {
+			e, err := Parse(tc.expr)
+			if err != nil {
+				t.Fatalf("expected Parse to not error, but did: %v", err)
+			}
+
+			if got := e.Eval(ctx); got != tc.expected {
+				t.Errorf("expected %s to be %v, but got: %v", tc.expr, tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	testCases := []struct {
+		expr   string
+		offset int
+	}{
+		{``, 0},
+		{`type ==`, 7},
+		{`type = "track"`, 5},
+		{`type == "track`, 8},
+		{`(type == "track"`, 16},
+		{`type == "track")`, 15},
+		{`type == "track" &&`, 18},
+		{`type & event`, 5},
+		{`event in "a"`, 9},
+		{`event in [type]`, 10},
+		{`event in ["a" "b"]`, 14},
+		{`revenue > 1.2.3`, 10},
+		{`in`, 0},
+		{`type == "a" && @topik == "events"`, 15},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.expr, func(t *testing.T) {
+			_, err := Parse(tc.expr)
+			e, ok := err.(*SyntaxError)
+			if !ok || e.Offset != tc.offset {
+				t.Errorf("expected Parse to fail at %d, but got: %v", tc.offset, err)
+			}
+		})
+	}
+}
+
+func TestExprMatch(t *testing.T) {
+	e, err := Parse(`type == "track"`)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `type == "track"`, fmt.Sprint(e))
+
+	m, err := broadcast.NewMessage("nsq_message_id_1", `{"type":"track"}`)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, e.Match(m))
+
+	m, err = broadcast.NewMessage("nsq_message_id_2", `{"type":"identify"}`)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, e.Match(m))
+}
+
+func TestExprVariables(t *testing.T) {
+	e, err := Parse(`type == "track" && (@topic != "test" || !type) && context.ip in ["a", null]`)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"type", "@topic", "context.ip"}, e.Variables())
+
+	e, err = Parse(`true`)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string(nil), e.Variables())
+}
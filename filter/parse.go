@@ -0,0 +1,311 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/segmentio/nsq_to_redis/template"
+	"github.com/tidwall/gjson"
+)
+
+var ErrUnterminatedString = errors.New("unterminated string")
+
+// SyntaxError is an error parsing an expression.
+type SyntaxError struct {
+	Offset int // Byte offset of the error in the expression
+	Err    error
+}
+
+// Error implements error.
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("filter: at %d: %s", e.Offset, e.Err)
+}
+
+// Token kinds.
+const (
+	tEOF = iota
+	tPath
+	tString
+	tNumber
+	tOp
+)
+
+type token struct {
+	kind   int
+	text   string
+	offset int
+}
+
+// lexer splits an expression into tokens.
+type lexer struct {
+	src string
+	pos int
+}
+
+// Operators, longest first.
+var operators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ","}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.src) && strings.IndexByte(" \t\r\n", l.src[l.pos]) >= 0 {
+		l.pos++
+	}
+
+	start := l.pos
+	if start == len(l.src) {
+		return token{tEOF, "", start}, nil
+	}
+
+	for _, op := range operators {
+		if strings.HasPrefix(l.src[start:], op) {
+			l.pos += len(op)
+			return token{tOp, op, start}, nil
+		}
+	}
+
+	switch c := l.src[start]; {
+	case c == '"':
+		for l.pos++; l.pos < len(l.src); l.pos++ {
+			switch l.src[l.pos] {
+			case '\\':
+				l.pos++
+			case '"':
+				l.pos++
+				return token{tString, l.src[start:l.pos], start}, nil
+			}
+		}
+		return token{}, &SyntaxError{start, ErrUnterminatedString}
+	case c == '-' || c >= '0' && c <= '9':
+		for l.pos++; l.pos < len(l.src) && strings.IndexByte("0123456789.eE+-", l.src[l.pos]) >= 0; l.pos++ {
+		}
+		return token{tNumber, l.src[start:l.pos], start}, nil
+	default:
+		for ; l.pos < len(l.src); l.pos++ {
+			if l.src[l.pos] == '\\' {
+				l.pos++
+				continue
+			}
+			if strings.IndexByte(" \t\r\n\"=!<>&|()[],", l.src[l.pos]) >= 0 {
+				break
+			}
+		}
+		if l.pos > len(l.src) {
+			l.pos = len(l.src)
+		}
+		if l.pos == start {
+			return token{}, &SyntaxError{start, fmt.Errorf("unexpected %q", c)}
+		}
+		return token{tPath, l.src[start:l.pos], start}, nil
+	}
+}
+
+// parser is a recursive descent parser:
+//
+//	or      = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | "(" or ")" | operand [ op operand | "in" list ]
+//	list    = "[" [ literal { "," literal } ] "]"
+//	operand = path | literal
+type parser struct {
+	lexer
+	tok   token
+	paths []string // operands which are paths, in order
+}
+
+func (p *parser) next() (err error) {
+	p.tok, err = p.lexer.next()
+	return err
+}
+
+// is returns true if the current token is the given operator.
+func (p *parser) is(op string) bool {
+	return p.tok.kind == tOp && p.tok.text == op
+}
+
+// expect consumes the given operator.
+func (p *parser) expect(op string) error {
+	if !p.is(op) {
+		return p.unexpected()
+	}
+	return p.next()
+}
+
+func (p *parser) unexpected() error {
+	if p.tok.kind == tEOF {
+		return &SyntaxError{p.tok.offset, errors.New("unexpected end of expression")}
+	}
+	return &SyntaxError{p.tok.offset, fmt.Errorf("unexpected %q", p.tok.text)}
+}
+
+func (p *parser) or() (boolean, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.is("||") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = or{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) and() (boolean, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.is("&&") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = and{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) unary() (boolean, error) {
+	switch {
+	case p.is("!"):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return not{n}, nil
+	case p.is("("):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return n, p.expect(")")
+	}
+
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case p.tok.kind == tPath && p.tok.text == "in":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		list, err := p.list()
+		if err != nil {
+			return nil, err
+		}
+		return in{left, list}, nil
+	case p.is("==") || p.is("!=") || p.is("<") || p.is("<=") || p.is(">") || p.is(">="):
+		op := p.tok.text
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		return compare{op, left, right}, nil
+	default:
+		return truthy{left}, nil
+	}
+}
+
+func (p *parser) list() ([]gjson.Result, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+
+	var list []gjson.Result
+	for !p.is("]") {
+		if len(list) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+
+		tok := p.tok
+		n, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+
+		l, ok := n.(literal)
+		if !ok {
+			return nil, &SyntaxError{tok.offset, errors.New("literal expected")}
+		}
+		list = append(list, gjson.Result(l))
+	}
+
+	return list, p.next()
+}
+
+func (p *parser) operand() (operand, error) {
+	tok := p.tok
+	var n operand
+
+	switch tok.kind {
+	case tString:
+		s, err := strconv.Unquote(tok.text)
+		if err != nil {
+			return nil, &SyntaxError{tok.offset, err}
+		}
+		n = literal{Type: gjson.String, Str: s}
+	case tNumber:
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, &SyntaxError{tok.offset, fmt.Errorf("invalid number %q", tok.text)}
+		}
+		n = literal{Type: gjson.Number, Num: f, Raw: tok.text}
+	case tPath:
+		switch tok.text {
+		case "true":
+			n = literal{Type: gjson.True}
+		case "false":
+			n = literal{Type: gjson.False}
+		case "null":
+			n = literal{Type: gjson.Null}
+		case "in":
+			return nil, p.unexpected()
+		default:
+			if strings.HasPrefix(tok.text, "@") && !reserved(tok.text[1:]) {
+				return nil, &SyntaxError{tok.offset, template.ErrUnknownVariable}
+			}
+			n = path(tok.text)
+			p.paths = append(p.paths, tok.text)
+		}
+	default:
+		return nil, p.unexpected()
+	}
+
+	return n, p.next()
+}
+
+// reserved returns true if name is a reserved variable.
+func reserved(name string) bool {
+	for _, r := range template.Reserved {
+		if name == r {
+			return true
+		}
+	}
+	return false
+}
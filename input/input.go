@@ -0,0 +1,35 @@
+// Package input provides decoders for message bodies which aren't JSON.
+// MessagePack and Protobuf bodies are decoded to JSON documents so that
+// templates and filters can address their fields, raw bodies are passed
+// as is and templates can only use reserved variables such as @topic.
+package input
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+var (
+	ErrTruncated   = errors.New("truncated message")
+	ErrTrailing    = errors.New("trailing bytes after message")
+	ErrUnsupported = errors.New("unsupported type")
+	ErrTooDeep     = errors.New("too deeply nested")
+)
+
+// maxDepth is the maximum nesting of arrays, maps and messages.
+const maxDepth = 10000
+
+// Raw passes message bodies as is.
+type Raw struct{}
+
+// Decode implements broadcast.Decoder.
+func (Raw) Decode([]byte) (json.RawMessage, error) {
+	return nil, nil
+}
+
+// writeString writes s as a JSON string.
+func writeString(b *bytes.Buffer, s string) {
+	v, _ := json.Marshal(s)
+	b.Write(v)
+}
@@ -0,0 +1,210 @@
+package input
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestRaw(t *testing.T) {
+	doc, err := Raw{}.Decode([]byte("not json"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(doc))
+}
+
+func TestMessagePack(t *testing.T) {
+	body, _ := hex.DecodeString("89" +
+		"a16101" + // "a": 1
+		"a16292c3c0" + // "b": [true, nil]
+		"a163cbc004000000000000" + // "c": -2.5
+		"a164a26869" + // "d": "hi"
+		"a165d09c" + // "e": -100
+		"a166cd012c" + // "f": 300
+		"01a178" + // 1: "x"
+		"a167c4026869" + // "g": bin "hi"
+		"a168d6ff58f143df") // "h": timestamp
+
+	doc, err := MessagePack{}.Decode(body)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"a":1,"b":[true,null],"c":-2.5,"d":"hi","e":-100,"f":300,"1":"x",`+
+		`"g":"aGk=","h":"2017-04-14T21:49:19Z"}`, string(doc))
+}
+
+func TestMessagePackInvalid(t *testing.T) {
+	for body, want := range map[string]error{
+		"":       ErrTruncated,
+		"82a161": ErrTruncated,
+		"c1":     ErrUnsupported,
+		"0101":   ErrTrailing,
+		"d40100": ErrUnsupported,
+	} {
+		b, _ := hex.DecodeString(body)
+		_, err := MessagePack{}.Decode(b)
+		assert.Equal(t, want, err, body)
+	}
+
+	deep := append(bytes.Repeat([]byte{0x91}, maxDepth), 0x90)
+	_, err := MessagePack{}.Decode(deep[1:])
+	assert.Equal(t, nil, err)
+	_, err = MessagePack{}.Decode(deep)
+	assert.Equal(t, ErrTooDeep, err)
+}
+
+// pb appends protobuf fields, strings, []byte and nested
+// pb are written as bytes, other values as varints.
+type pb []byte
+
+func (p pb) add(num int, v interface{}) pb {
+	switch v := v.(type) {
+	case string:
+		return p.bytes(num, []byte(v))
+	case []byte:
+		return p.bytes(num, v)
+	case pb:
+		return p.bytes(num, v)
+	case int:
+		p = p.key(num, wireVarint)
+		return appendVarint(p, uint64(v))
+	}
+	panic("unsupported value")
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(b, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+func (p pb) key(num, wire int) pb {
+	return appendVarint(p, uint64(num<<3|wire))
+}
+
+func (p pb) bytes(num int, b []byte) pb {
+	p = p.key(num, wireBytes)
+	p = appendVarint(p, uint64(len(b)))
+	return append(p, b...)
+}
+
+func fieldDescriptor(name string, number, label, kind int, typeName string) pb {
+	f := pb{}.add(1, name).add(3, number).add(4, label).add(5, kind)
+	if typeName != "" {
+		f = f.add(6, typeName)
+	}
+	return f
+}
+
+// descriptorSet returns a descriptor set with the message:
+//
+//	package events;
+//
+//	message Event {
+//	  message Context { string ip = 1; }
+//	  enum Type { UNKNOWN = 0; TRACK = 1; }
+//	  string user_id = 1;
+//	  int64 timestamp = 2;
+//	  repeated int32 scores = 3;
+//	  Context context = 4;
+//	  Type type = 5;
+//	  map<string, string> tags = 6;
+//	  sint32 delta = 7;
+//	  double ratio = 8;
+//	  bytes raw = 9;
+//	}
+func descriptorSet() []byte {
+	context := pb{}.add(1, "Context").
+		add(2, fieldDescriptor("ip", 1, 1, typeString, ""))
+
+	entry := pb{}.add(1, "TagsEntry").
+		add(2, fieldDescriptor("key", 1, 1, typeString, "")).
+		add(2, fieldDescriptor("value", 2, 1, typeString, "")).
+		add(7, pb{}.add(7, 1))
+
+	enum := pb{}.add(1, "Type").
+		add(2, pb{}.add(1, "UNKNOWN").add(2, 0)).
+		add(2, pb{}.add(1, "TRACK").add(2, 1))
+
+	event := pb{}.add(1, "Event").
+		add(2, fieldDescriptor("user_id", 1, 1, typeString, "")).
+		add(2, fieldDescriptor("timestamp", 2, 1, typeInt64, "")).
+		add(2, fieldDescriptor("scores", 3, 3, typeInt32, "")).
+		add(2, fieldDescriptor("context", 4, 1, typeMessage, ".events.Event.Context")).
+		add(2, fieldDescriptor("type", 5, 1, typeEnum, ".events.Event.Type")).
+		add(2, fieldDescriptor("tags", 6, 3, typeMessage, ".events.Event.TagsEntry")).
+		add(2, fieldDescriptor("delta", 7, 1, typeSint32, "")).
+		add(2, fieldDescriptor("ratio", 8, 1, typeDouble, "")).
+		add(2, fieldDescriptor("raw", 9, 1, typeBytes, "")).
+		add(3, context).
+		add(3, entry).
+		add(4, enum)
+
+	file := pb{}.add(1, "events.proto").add(2, "events").add(4, event)
+	return pb{}.add(1, file)
+}
+
+func TestProtobuf(t *testing.T) {
+	p, err := NewProtobuf(descriptorSet(), "events.Event")
+	assert.Equal(t, nil, err)
+
+	scores := appendVarint(nil, 1)
+	scores = appendVarint(scores, uint64(math.MaxUint64-1)) // int32 -2
+
+	ratio := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ratio, math.Float64bits(0.5))
+
+	body := pb{}.
+		add(15, 42). // unknown
+		add(1, "u").
+		add(2, 1492206559).
+		add(3, scores).
+		add(4, pb{}.add(1, "1.2.3.4")).
+		add(5, 1).
+		add(6, pb{}.add(1, "a").add(2, "b")).
+		add(6, pb{}.add(1, "c").add(2, "d")).
+		add(7, 5) // zigzag -3
+	body = append(body.key(8, wireFixed64), ratio...)
+	body = body.add(9, "hi")
+
+	doc, err := p.Decode(body)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"user_id":"u","timestamp":1492206559,"scores":[1,-2],`+
+		`"context":{"ip":"1.2.3.4"},"type":"TRACK","tags":{"a":"b","c":"d"},`+
+		`"delta":-3,"ratio":0.5,"raw":"aGk="}`, string(doc))
+}
+
+func TestProtobufInvalid(t *testing.T) {
+	_, err := NewProtobuf(descriptorSet(), "events.Missing")
+	assert.NotEqual(t, nil, err)
+
+	p, err := NewProtobuf(descriptorSet(), ".events.Event")
+	assert.Equal(t, nil, err)
+
+	_, err = p.Decode(pb{}.add(1, 1))
+	assert.Equal(t, ErrInvalidWireType, err)
+
+	_, err = p.Decode(pb{}.add(1, "user")[:4])
+	assert.Equal(t, ErrTruncated, err)
+}
+
+func TestProtobufTooDeep(t *testing.T) {
+	// message Node { Node child = 1; }
+	node := pb{}.add(1, "Node").
+		add(2, fieldDescriptor("child", 1, 1, typeMessage, ".Node"))
+	set := pb{}.add(1, pb{}.add(1, "node.proto").add(4, node))
+
+	p, err := NewProtobuf(set, "Node")
+	assert.Equal(t, nil, err)
+
+	body := pb{}
+	for i := 0; i < maxDepth; i++ {
+		body = pb{}.add(1, body)
+	}
+	_, err = p.Decode(body)
+	assert.Equal(t, ErrTooDeep, err)
+
+	doc, err := p.Decode(pb{}.add(1, pb{}))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"child":{}}`, string(doc))
+}
@@ -0,0 +1,277 @@
+package input
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+)
+
+// MessagePack decodes MessagePack bodies. Binary values are written as
+// base64 strings, timestamps as RFC 3339 strings and map keys which
+// aren't strings as their JSON text.
+type MessagePack struct{}
+
+// Decode implements broadcast.Decoder.
+func (MessagePack) Decode(body []byte) (json.RawMessage, error) {
+	d := &msgpack{src: body}
+
+	var b bytes.Buffer
+	if err := d.value(&b); err != nil {
+		return nil, err
+	}
+
+	if d.pos != len(d.src) {
+		return nil, ErrTrailing
+	}
+
+	return b.Bytes(), nil
+}
+
+// msgpack is a MessagePack to JSON decoder.
+type msgpack struct {
+	src   []byte
+	pos   int
+	depth int // of the array or map being decoded
+}
+
+// read returns the next n bytes.
+func (d *msgpack) read(n int) ([]byte, error) {
+	if n < 0 || n > len(d.src)-d.pos {
+		return nil, ErrTruncated
+	}
+	b := d.src[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// uint reads a big endian unsigned integer of n bytes.
+func (d *msgpack) uint(n int) (uint64, error) {
+	b, err := d.read(n)
+	if err != nil {
+		return 0, err
+	}
+
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+// value writes the next value as JSON.
+func (d *msgpack) value(b *bytes.Buffer) error {
+	t, err := d.uint(1)
+	if err != nil {
+		return err
+	}
+
+	switch c := byte(t); {
+	case c <= 0x7f:
+		b.WriteString(strconv.Itoa(int(c)))
+		return nil
+	case c >= 0xe0:
+		b.WriteString(strconv.Itoa(int(int8(c))))
+		return nil
+	case c >= 0x80 && c <= 0x8f:
+		return d.object(b, int(c&0x0f))
+	case c >= 0x90 && c <= 0x9f:
+		return d.array(b, int(c&0x0f))
+	case c >= 0xa0 && c <= 0xbf:
+		return d.str(b, int(c&0x1f))
+	}
+
+	switch t {
+	case 0xc0:
+		b.WriteString("null")
+	case 0xc2:
+		b.WriteString("false")
+	case 0xc3:
+		b.WriteString("true")
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (t - 0xc4))
+		if err != nil {
+			return err
+		}
+		v, err := d.read(int(n))
+		if err != nil {
+			return err
+		}
+		b.WriteByte('"')
+		b.WriteString(base64.StdEncoding.EncodeToString(v))
+		b.WriteByte('"')
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.uint(1 << (t - 0xc7))
+		if err != nil {
+			return err
+		}
+		return d.ext(b, int(n))
+	case 0xca:
+		v, err := d.uint(4)
+		if err != nil {
+			return err
+		}
+		writeFloat(b, float64(math.Float32frombits(uint32(v))), 32)
+	case 0xcb:
+		v, err := d.uint(8)
+		if err != nil {
+			return err
+		}
+		writeFloat(b, math.Float64frombits(v), 64)
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := d.uint(1 << (t - 0xcc))
+		if err != nil {
+			return err
+		}
+		b.WriteString(strconv.FormatUint(v, 10))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		n := 1 << (t - 0xd0)
+		v, err := d.uint(n)
+		if err != nil {
+			return err
+		}
+		// sign extend
+		shift := uint(64 - 8*n)
+		b.WriteString(strconv.FormatInt(int64(v<<shift)>>shift, 10))
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.ext(b, 1<<(t-0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (t - 0xd9))
+		if err != nil {
+			return err
+		}
+		return d.str(b, int(n))
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (t - 0xdc))
+		if err != nil {
+			return err
+		}
+		return d.array(b, int(n))
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (t - 0xde))
+		if err != nil {
+			return err
+		}
+		return d.object(b, int(n))
+	default:
+		return ErrUnsupported
+	}
+
+	return nil
+}
+
+func (d *msgpack) str(b *bytes.Buffer, n int) error {
+	v, err := d.read(n)
+	if err != nil {
+		return err
+	}
+	writeString(b, string(v))
+	return nil
+}
+
+func (d *msgpack) array(b *bytes.Buffer, n int) error {
+	if d.depth == maxDepth {
+		return ErrTooDeep
+	}
+	d.depth++
+	defer func() { d.depth-- }()
+
+	b.WriteByte('[')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		if err := d.value(b); err != nil {
+			return err
+		}
+	}
+	b.WriteByte(']')
+	return nil
+}
+
+func (d *msgpack) object(b *bytes.Buffer, n int) error {
+	if d.depth == maxDepth {
+		return ErrTooDeep
+	}
+	d.depth++
+	defer func() { d.depth-- }()
+
+	var key bytes.Buffer
+	b.WriteByte('{')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		key.Reset()
+		if err := d.value(&key); err != nil {
+			return err
+		}
+		if key.Bytes()[0] == '"' {
+			b.Write(key.Bytes())
+		} else {
+			writeString(b, key.String())
+		}
+
+		b.WriteByte(':')
+		if err := d.value(b); err != nil {
+			return err
+		}
+	}
+	b.WriteByte('}')
+	return nil
+}
+
+// ext writes an extension value of n bytes,
+// only timestamps (type -1) are supported.
+func (d *msgpack) ext(b *bytes.Buffer, n int) error {
+	t, err := d.uint(1)
+	if err != nil {
+		return err
+	}
+
+	v, err := d.read(n)
+	if err != nil {
+		return err
+	}
+
+	if int8(t) != -1 {
+		return ErrUnsupported
+	}
+
+	var sec, nsec int64
+	switch n {
+	case 4:
+		sec = int64(binary.BigEndian.Uint32(v))
+	case 8:
+		x := binary.BigEndian.Uint64(v)
+		sec = int64(x & (1<<34 - 1))
+		nsec = int64(x >> 34)
+	case 12:
+		nsec = int64(binary.BigEndian.Uint32(v))
+		sec = int64(binary.BigEndian.Uint64(v[4:]))
+	default:
+		return ErrUnsupported
+	}
+
+	writeString(b, time.Unix(sec, nsec).UTC().Format(time.RFC3339Nano))
+	return nil
+}
+
+// writeFloat writes f as a JSON number, or
+// a string if it is NaN or infinite.
+func writeFloat(b *bytes.Buffer, f float64, bits int) {
+	switch {
+	case math.IsNaN(f):
+		b.WriteString(`"NaN"`)
+	case math.IsInf(f, 1):
+		b.WriteString(`"Infinity"`)
+	case math.IsInf(f, -1):
+		b.WriteString(`"-Infinity"`)
+	default:
+		b.WriteString(strconv.FormatFloat(f, 'g', -1, bits))
+	}
+}
@@ -0,0 +1,526 @@
+package input
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidWireType = errors.New("invalid wire type")
+
+// Wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// Field labels and types of descriptor.proto.
+const (
+	labelRepeated = 3
+
+	typeDouble   = 1
+	typeFloat    = 2
+	typeInt64    = 3
+	typeUint64   = 4
+	typeInt32    = 5
+	typeFixed64  = 6
+	typeFixed32  = 7
+	typeBool     = 8
+	typeString   = 9
+	typeGroup    = 10
+	typeMessage  = 11
+	typeBytes    = 12
+	typeUint32   = 13
+	typeEnum     = 14
+	typeSfixed32 = 15
+	typeSfixed64 = 16
+	typeSint32   = 17
+	typeSint64   = 18
+)
+
+// Protobuf decodes Protobuf bodies with a descriptor set, as written by
+// `protoc --include_imports --descriptor_set_out`. Fields are named as
+// in their .proto file, 64 bit integers are written as numbers, bytes as
+// base64 strings and enums as the names of their values. Unknown fields
+// are skipped, groups aren't supported.
+type Protobuf struct {
+	message *message
+}
+
+// message is a message descriptor.
+type message struct {
+	name     string
+	fields   []*field
+	numbers  map[uint64]*field
+	mapEntry bool
+}
+
+// field is a field descriptor.
+type field struct {
+	name     string
+	number   uint64
+	label    uint64
+	kind     uint64
+	typeName string
+	message  *message
+	enum     map[uint64]string
+}
+
+// NewProtobuf returns a decoder of the message with the fully qualified
+// name, such as "events.Event", from the serialized FileDescriptorSet.
+func NewProtobuf(set []byte, name string) (*Protobuf, error) {
+	messages := make(map[string]*message)
+	enums := make(map[string]map[uint64]string)
+
+	err := each(set, func(num, wire int, _ uint64, b []byte) error {
+		if num != 1 || wire != wireBytes {
+			return nil
+		}
+		return parseFile(b, messages, enums)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("parsing descriptor set: %s", err)
+	}
+
+	for _, m := range messages {
+		for _, f := range m.fields {
+			switch f.kind {
+			case typeMessage:
+				if f.message = messages[f.typeName]; f.message == nil {
+					return nil, fmt.Errorf("message %s not in descriptor set", f.typeName)
+				}
+			case typeEnum:
+				if f.enum = enums[f.typeName]; f.enum == nil {
+					return nil, fmt.Errorf("enum %s not in descriptor set", f.typeName)
+				}
+			}
+		}
+	}
+
+	m := messages["."+strings.TrimPrefix(name, ".")]
+	if m == nil {
+		return nil, fmt.Errorf("message %s not in descriptor set", name)
+	}
+
+	return &Protobuf{m}, nil
+}
+
+// Decode implements broadcast.Decoder.
+func (p *Protobuf) Decode(body []byte) (json.RawMessage, error) {
+	var b bytes.Buffer
+	if err := writeMessage(&b, p.message, body, 0); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// writeMessage writes the message m encoded in src as a JSON object,
+// its fields in the order they are declared. depth is the number of
+// messages m is nested in.
+func writeMessage(b *bytes.Buffer, m *message, src []byte, depth int) error {
+	if depth == maxDepth {
+		return ErrTooDeep
+	}
+
+	values := make(map[*field][][]byte)
+	err := each(src, func(num, wire int, v uint64, data []byte) error {
+		f := m.numbers[uint64(num)]
+		if f == nil {
+			return nil
+		}
+
+		// packed repeated scalars
+		if wire == wireBytes && f.label == labelRepeated && packable(f.kind) {
+			return eachPacked(f, data, func(v uint64) error {
+				values[f] = append(values[f], fragment(f, v, nil))
+				return nil
+			})
+		}
+
+		if wire != wireType(f.kind) {
+			return ErrInvalidWireType
+		}
+
+		var frag []byte
+		if f.kind == typeMessage {
+			var sub bytes.Buffer
+			if err := writeMessage(&sub, f.message, data, depth+1); err != nil {
+				return err
+			}
+			frag = sub.Bytes()
+		} else {
+			frag = fragment(f, v, data)
+		}
+
+		if f.label == labelRepeated {
+			values[f] = append(values[f], frag)
+		} else {
+			values[f] = [][]byte{frag}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	b.WriteByte('{')
+	first := true
+	for _, f := range m.fields {
+		frags, ok := values[f]
+		if !ok {
+			continue
+		}
+
+		if !first {
+			b.WriteByte(',')
+		}
+		first = false
+
+		writeString(b, f.name)
+		b.WriteByte(':')
+		switch {
+		case f.label == labelRepeated && f.kind == typeMessage && f.message.mapEntry:
+			if err := writeMap(b, f.message, frags); err != nil {
+				return err
+			}
+		case f.label == labelRepeated:
+			b.WriteByte('[')
+			b.Write(bytes.Join(frags, []byte(",")))
+			b.WriteByte(']')
+		default:
+			b.Write(frags[0])
+		}
+	}
+	b.WriteByte('}')
+	return nil
+}
+
+// writeMap writes the decoded entries of a map field as a JSON object.
+func writeMap(b *bytes.Buffer, entry *message, entries [][]byte) error {
+	b.WriteByte('{')
+	for i, e := range entries {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		var kv struct {
+			Key   json.RawMessage `json:"key"`
+			Value json.RawMessage `json:"value"`
+		}
+		if err := json.Unmarshal(e, &kv); err != nil {
+			return err
+		}
+
+		switch {
+		case kv.Key == nil:
+			b.WriteString(`""`)
+		case kv.Key[0] == '"':
+			b.Write(kv.Key)
+		default:
+			writeString(b, string(kv.Key))
+		}
+
+		b.WriteByte(':')
+		if kv.Value == nil {
+			b.WriteString("null")
+		} else {
+			b.Write(kv.Value)
+		}
+	}
+	b.WriteByte('}')
+	return nil
+}
+
+// fragment returns the JSON of a scalar value, v for numeric
+// wire types and data for strings and bytes.
+func fragment(f *field, v uint64, data []byte) []byte {
+	var b bytes.Buffer
+	switch f.kind {
+	case typeDouble:
+		writeFloat(&b, math.Float64frombits(v), 64)
+	case typeFloat:
+		writeFloat(&b, float64(math.Float32frombits(uint32(v))), 32)
+	case typeInt64, typeSfixed64:
+		b.WriteString(strconv.FormatInt(int64(v), 10))
+	case typeInt32, typeSfixed32:
+		b.WriteString(strconv.FormatInt(int64(int32(v)), 10))
+	case typeUint64, typeFixed64, typeUint32, typeFixed32:
+		b.WriteString(strconv.FormatUint(v, 10))
+	case typeSint32, typeSint64:
+		b.WriteString(strconv.FormatInt(int64(v>>1)^-int64(v&1), 10))
+	case typeBool:
+		b.WriteString(strconv.FormatBool(v != 0))
+	case typeEnum:
+		if name, ok := f.enum[v]; ok {
+			writeString(&b, name)
+		} else {
+			b.WriteString(strconv.FormatInt(int64(int32(v)), 10))
+		}
+	case typeString:
+		writeString(&b, string(data))
+	case typeBytes:
+		writeString(&b, base64.StdEncoding.EncodeToString(data))
+	}
+	return b.Bytes()
+}
+
+// wireType returns the wire type of a field type.
+func wireType(kind uint64) int {
+	switch kind {
+	case typeDouble, typeFixed64, typeSfixed64:
+		return wireFixed64
+	case typeFloat, typeFixed32, typeSfixed32:
+		return wireFixed32
+	case typeString, typeBytes, typeMessage:
+		return wireBytes
+	case typeGroup:
+		return -1
+	default:
+		return wireVarint
+	}
+}
+
+// packable returns true if repeated fields of the type can be packed.
+func packable(kind uint64) bool {
+	switch wireType(kind) {
+	case wireVarint, wireFixed64, wireFixed32:
+		return true
+	default:
+		return false
+	}
+}
+
+// eachPacked calls fn with each value of a packed repeated field.
+func eachPacked(f *field, data []byte, fn func(uint64) error) error {
+	for len(data) > 0 {
+		var v uint64
+		switch wireType(f.kind) {
+		case wireVarint:
+			var n int
+			if v, n = binary.Uvarint(data); n <= 0 {
+				return ErrTruncated
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return ErrTruncated
+			}
+			v, data = binary.LittleEndian.Uint64(data), data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return ErrTruncated
+			}
+			v, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		}
+
+		if err := fn(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// each calls fn with the number, wire type and value of each field
+// encoded in b, v for numeric wire types and data for length delimited.
+func each(b []byte, fn func(num, wire int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return ErrTruncated
+		}
+		b = b[n:]
+
+		var v uint64
+		var data []byte
+		switch wire := int(key & 7); wire {
+		case wireVarint:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return ErrTruncated
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return ErrTruncated
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return ErrTruncated
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return ErrTruncated
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			return ErrInvalidWireType
+		}
+
+		if err := fn(int(key>>3), int(key&7), v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseFile parses a FileDescriptorProto, adding its messages and enums.
+func parseFile(b []byte, messages map[string]*message, enums map[string]map[uint64]string) error {
+	var pkg string
+	var types, enumTypes [][]byte
+	err := each(b, func(num, wire int, _ uint64, data []byte) error {
+		switch num {
+		case 2:
+			pkg = string(data)
+		case 4:
+			types = append(types, data)
+		case 5:
+			enumTypes = append(enumTypes, data)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	scope := ""
+	if pkg != "" {
+		scope = "." + pkg
+	}
+
+	for _, data := range types {
+		if err := parseMessage(data, scope, messages, enums); err != nil {
+			return err
+		}
+	}
+
+	for _, data := range enumTypes {
+		if err := parseEnum(data, scope, enums); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseMessage parses a DescriptorProto and its nested types.
+func parseMessage(b []byte, scope string, messages map[string]*message, enums map[string]map[uint64]string) error {
+	m := &message{numbers: make(map[uint64]*field)}
+	var nested, enumTypes [][]byte
+	err := each(b, func(num, wire int, _ uint64, data []byte) error {
+		switch num {
+		case 1:
+			m.name = scope + "." + string(data)
+		case 2:
+			f, err := parseField(data)
+			if err != nil {
+				return err
+			}
+			m.fields = append(m.fields, f)
+			m.numbers[f.number] = f
+		case 3:
+			nested = append(nested, data)
+		case 4:
+			enumTypes = append(enumTypes, data)
+		case 7:
+			// MessageOptions.map_entry
+			return each(data, func(num, wire int, v uint64, _ []byte) error {
+				if num == 7 {
+					m.mapEntry = v != 0
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	messages[m.name] = m
+
+	for _, data := range nested {
+		if err := parseMessage(data, m.name, messages, enums); err != nil {
+			return err
+		}
+	}
+
+	for _, data := range enumTypes {
+		if err := parseEnum(data, m.name, enums); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseField parses a FieldDescriptorProto.
+func parseField(b []byte) (*field, error) {
+	f := new(field)
+	err := each(b, func(num, wire int, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			f.name = string(data)
+		case 3:
+			f.number = v
+		case 4:
+			f.label = v
+		case 5:
+			f.kind = v
+		case 6:
+			f.typeName = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if f.kind == typeGroup {
+		return nil, fmt.Errorf("field %s: groups are not supported", f.name)
+	}
+
+	return f, nil
+}
+
+// parseEnum parses an EnumDescriptorProto.
+func parseEnum(b []byte, scope string, enums map[string]map[uint64]string) error {
+	var name string
+	values := make(map[uint64]string)
+	err := each(b, func(num, wire int, _ uint64, data []byte) error {
+		switch num {
+		case 1:
+			name = string(data)
+		case 2:
+			var value string
+			var number uint64
+			err := each(data, func(num, wire int, v uint64, data []byte) error {
+				switch num {
+				case 1:
+					value = string(data)
+				case 2:
+					number = v
+				}
+				return nil
+			})
+			values[number] = value
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	enums[scope+"."+name] = values
+	return nil
+}
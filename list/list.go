@@ -6,16 +6,20 @@ import (
 	"github.com/segmentio/go-log"
 	"github.com/segmentio/go-stats"
 	"github.com/segmentio/nsq_to_redis/broadcast"
+	"github.com/segmentio/nsq_to_redis/payload"
 	"github.com/segmentio/nsq_to_redis/template"
 	"github.com/segmentio/statsdclient"
 )
 
 // Options for List.
 type Options struct {
-	Format  string         // Redis list key format
-	Metrics *statsd.Client // Metrics
-	Log     *log.Logger    // Logger
-	Size    int64          // List size
+	Format    string              // Redis list key format
+	Metrics   *statsd.Client      // Metrics
+	Log       *log.Logger         // Logger
+	Size      int64               // List size
+	Strict    bool                // Skip messages with missing or non-scalar fields
+	Sanitizer *template.Sanitizer // Key sanitizer, nil disables
+	Payload   *payload.Format     // Values written, nil writes the message as is
 }
 
 // List writes messages to capped lists.
@@ -37,6 +41,12 @@ func New(options *Options) (*List, error) {
 		return nil, err
 	}
 
+	if err := tmpl.Validate(); err != nil {
+		return nil, err
+	}
+
+	tmpl.Sanitizer = r.Sanitizer
+	tmpl.Strict = r.Strict
 	r.template = tmpl
 	go r.stats.TickEvery(10 * time.Second)
 
@@ -44,32 +54,43 @@ func New(options *Options) (*List, error) {
 }
 
 // HandleMessage expects parsed json messages from NSQ,
-// applies them against the key template to produce a
-// key name, and writes to the list.
+// applies them against the key template to produce
+// key names, and writes to the lists.
 func (l *List) Handle(c broadcast.Conn, msg *broadcast.Message) error {
 	start := time.Now()
 
-	key, err := l.template.Eval(string(msg.JSON))
+	keys, err := l.template.EvalAll(msg.Context())
 	if err != nil {
+		l.Metrics.Incr("errors.template." + template.Reason(err))
 		l.Log.Error("evaluating template: %s", err)
 		return nil
 	}
 
-	l.Log.Info("pushing %s to %s", msg.ID, key)
-	l.Log.Debug("contents %s %s", msg.ID, msg.JSON)
-
-	err = c.Send("LPUSH", key, []byte(msg.JSON))
+	value, err := l.Payload.Encode(msg)
 	if err != nil {
-		l.Log.Error("lpush: %s", err)
+		l.Metrics.Incr("errors.payload")
+		l.Log.Error("encoding payload: %s", err)
+		return nil
 	}
 
-	err = c.Send("LTRIM", key, 0, l.Size-1)
-	if err != nil {
-		l.Log.Error("ltrim: %s", err)
+	for _, key := range keys {
+		l.Log.Info("pushing %s to %s", msg.ID, key)
+		l.Log.Debug("contents %s %s", msg.ID, msg.JSON)
+
+		err = c.Send("LPUSH", key, value)
+		if err != nil {
+			l.Log.Error("lpush: %s", err)
+		}
+
+		err = c.Send("LTRIM", key, 0, l.Size-1)
+		if err != nil {
+			l.Log.Error("ltrim: %s", err)
+		}
+
+		l.Metrics.Incr("counts.pushed")
+		l.stats.Incr("pushed")
 	}
 
 	l.Metrics.Duration("timers.pushed", time.Since(start))
-	l.Metrics.Incr("counts.pushed")
-	l.stats.Incr("pushed")
 	return nil
 }
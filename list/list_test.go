@@ -10,6 +10,7 @@ import (
 	"github.com/segmentio/go-log"
 	"github.com/segmentio/nsq_to_redis/broadcast"
 	"github.com/segmentio/nsq_to_redis/broadcast/mocks"
+	"github.com/segmentio/nsq_to_redis/payload"
 	statsd "github.com/segmentio/statsdclient"
 )
 
@@ -45,6 +46,61 @@ func BenchmarkList(b *testing.B) {
 	}
 }
 
+func TestListFanout(t *testing.T) {
+	list, err := New(&Options{
+		Format:  "audiences:{audiences}",
+		Log:     log.Log.New("list_test"),
+		Metrics: statsd.NewClient(ioutil.Discard),
+		Size:    50,
+	})
+	assert.Equal(t, nil, err)
+
+	contents := `{"audiences":["a","b"]}`
+	conn := &mocks.Conn{}
+	for _, key := range []string{"audiences:a", "audiences:b"} {
+		conn.On("Send", "LPUSH", []interface{}{key, []byte(contents)}).Return(nil).Once()
+		conn.On("Send", "LTRIM", []interface{}{key, 0, int64(49)}).Return(nil).Once()
+	}
+
+	msg, err := broadcast.NewMessage("nsq_message_id_1", contents)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, list.Handle(conn, msg))
+	conn.AssertExpectations(t)
+}
+
+func TestListInvalidFormat(t *testing.T) {
+	_, err := New(&Options{
+		Format:  "events:{context..id}",
+		Log:     log.Log.New("list_test"),
+		Metrics: statsd.NewClient(ioutil.Discard),
+		Size:    50,
+	})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestListProjection(t *testing.T) {
+	projection, err := payload.NewProjection([]string{"userId", "event"}, nil)
+	assert.Equal(t, nil, err)
+
+	list, err := New(&Options{
+		Format:  "events:{projectId}",
+		Log:     log.Log.New("list_test"),
+		Metrics: statsd.NewClient(ioutil.Discard),
+		Size:    50,
+		Payload: &payload.Format{Projection: projection},
+	})
+	assert.Equal(t, nil, err)
+
+	conn := &mocks.Conn{}
+	conn.On("Send", "LPUSH", []interface{}{"events:gy2d", []byte(`{"event":"e","userId":"u"}`)}).Return(nil).Once()
+	conn.On("Send", "LTRIM", []interface{}{"events:gy2d", 0, int64(49)}).Return(nil).Once()
+
+	msg, err := broadcast.NewMessage("nsq_message_id_1", `{"projectId":"gy2d","userId":"u","event":"e","context":{}}`)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, list.Handle(conn, msg))
+	conn.AssertExpectations(t)
+}
+
 func TestList(t *testing.T) {
 	list, err := New(&Options{
 		Format:  "stream:persist:{projectId}:ingress",
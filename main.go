@@ -1,17 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"io/ioutil"
+	"net"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bitly/go-nsq"
 	"github.com/garyburd/redigo/redis"
 	"github.com/segmentio/go-log"
 	"github.com/segmentio/nsq_to_redis/broadcast"
+	"github.com/segmentio/nsq_to_redis/filter"
+	"github.com/segmentio/nsq_to_redis/input"
 	"github.com/segmentio/nsq_to_redis/list"
+	"github.com/segmentio/nsq_to_redis/payload"
 	"github.com/segmentio/nsq_to_redis/pubsub"
 	"github.com/segmentio/nsq_to_redis/ratelimit"
+	"github.com/segmentio/nsq_to_redis/sample"
+	"github.com/segmentio/nsq_to_redis/template"
 	"github.com/segmentio/statsdclient"
 	"github.com/tj/docopt"
 	"github.com/tj/go-gracefully"
@@ -28,12 +37,33 @@ const usage = `
       [--statsd-prefix prefix]
       [--lookupd-http-address addr...]
       [--nsqd-tcp-address addr...]
-      [--redis-address addr]
+      [--redis-address addr] [--redis-db n]
       [--flush-interval t]
-      [--max-idle n]
-      [--idle-timeout t]
-      [--list name] [--list-size n]
-      [--publish name]
+      [--flush-max-commands n] [--flush-max-bytes n]
+      [--pipelines n]
+      [--atomic]
+      [--max-idle n] [--max-active n] [--wait]
+      [--idle-timeout t] [--max-conn-lifetime t]
+      [--dial-timeout t] [--read-timeout t] [--write-timeout t]
+      [--keepalive t]
+      [--list name] [--list-size n] [--list-db n] [--list-filter expr]
+      [--list-keep paths] [--list-drop paths] [--list-envelope]
+      [--list-encoding name]
+      [--list-sample rate] [--list-sample-key key]
+      [--publish name] [--publish-filter expr]
+      [--publish-keep paths] [--publish-drop paths] [--publish-envelope]
+      [--publish-encoding name]
+      [--publish-sample rate] [--publish-sample-key key]
+      [--encoding-header]
+      [--input name] [--proto-descriptor file] [--proto-message name]
+      [--filter expr]
+      [--max-message-bytes n] [--oversize policy]
+      [--truncate-field path] [--dead-letter key] [--dead-letter-size n]
+      [--mask paths] [--hash paths] [--hash-secret file]
+      [--route rule...]
+      [--strict]
+      [--sanitize-keys] [--max-key-length n]
+      [--template-sample file]
       [--level name]
       [--ratelimit-key key]
       [--ratelimit-max-rate n]
@@ -45,15 +75,60 @@ const usage = `
   Options:
     --lookupd-http-address addr  nsqlookupd addresses [default: :4161]
     --nsqd-tcp-address addr      nsqd tcp addresses
-    --redis-address addr         redis address [default: :6379]
+    --redis-address addr         redis address, or unix:///path/to/redis.sock [default: :6379]
+    --redis-db n                 redis database [default: 0]
     --max-attempts n             nsq max message attempts [default: 5]
     --max-in-flight n            nsq messages in-flight [default: 250]
     --flush-interval t           time to buffer redis commands before flushing [default: 0s]
+    --flush-max-commands n       flush early once n commands are buffered, 0 disables [default: 0]
+    --flush-max-bytes n          flush early once n bytes are buffered, 0 disables [default: 0]
+    --pipelines n                redis connections to pipeline on when flushing on an interval [default: 1]
+    --atomic                     write the commands for each message in a MULTI/EXEC transaction, requires --pipelines 1 and a single database
     --max-idle n                 redis max idle connections [default: 15]
+    --max-active n               redis max active connections, 0 is unlimited [default: 100]
+    --wait                       wait for a connection when max-active is reached instead of failing
     --idle-timeout t             idle connection timeout [default: 1m]
+    --max-conn-lifetime t        close pooled connections older than t, 0 disables [default: 0s]
+    --dial-timeout t             redis connect timeout [default: 5s]
+    --read-timeout t             redis read timeout, 0 disables [default: 10s]
+    --write-timeout t            redis write timeout, 0 disables [default: 10s]
+    --keepalive t                tcp keepalive period, 0 disables [default: 5m]
     --list-size n                redis list size [default: 100]
     --list name                  redis list template
+    --list-db n                  redis database for lists, defaults to --redis-db
+    --list-filter expr           only list messages matching expr
     --publish name               redis channel template
+    --publish-filter expr        only publish messages matching expr
+    --list-sample rate           only list a sample of messages, for example "1%" or 0.01
+    --list-sample-key key        sample by the hash of this template, for example "{userId}", keeping all or none of the messages of a key
+    --publish-sample rate        only publish a sample of messages like --list-sample
+    --publish-sample-key key     sample published messages by key like --list-sample-key
+    --list-keep paths            only list these fields, for example "{userId,event,timestamp}"
+    --list-drop paths            list messages without these fields, for example "context,traits.email"
+    --publish-keep paths         only publish these fields
+    --publish-drop paths         publish messages without these fields
+    --list-envelope              list messages wrapped with their id, topic, attempts, nsq_timestamp and received_at
+    --publish-envelope           publish messages wrapped with their NSQ metadata like --list-envelope
+    --list-encoding name         encode listed messages as json, msgpack, cbor, snappy, gzip or zstd [default: json]
+    --publish-encoding name      encode published messages like --list-encoding [default: json]
+    --encoding-header            prefix values with a byte identifying their encoding, 0 json, 1 msgpack, 2 cbor, 3 snappy, 4 gzip, 5 zstd
+    --strict                     skip messages with missing, null or object template variables, or arrays of them
+    --template-sample file       check the templates render against the JSON document in file on startup
+    --sanitize-keys              replace whitespace and control characters in keys with "_", skip keys with empty ":" segments
+    --max-key-length n           shorten longer keys to n bytes ending with a hash, 0 disables [default: 0]
+    --filter expr                discard messages not matching expr, for example 'type == "track"'
+    --max-message-bytes n        apply the --oversize policy to larger messages, 0 disables [default: 0]
+    --oversize policy            skip, truncate or dead-letter messages over --max-message-bytes [default: skip]
+    --truncate-field path        string field shortened by --oversize truncate, for example "properties.body"
+    --dead-letter key            redis list template --oversize dead-letter pushes messages to, for example "oversize:{@topic}"
+    --dead-letter-size n         dead letter list size [default: 100]
+    --input name                 decode messages as json, msgpack, protobuf or raw, raw messages are written as is [default: json]
+    --proto-descriptor file      protobuf descriptor set, from protoc --include_imports --descriptor_set_out
+    --proto-message name         fully qualified protobuf message name, for example "events.Event"
+    --mask paths                 replace these fields with "[redacted]" before handlers see messages, for example "traits.email,context.ip"
+    --hash paths                 replace these fields with their SHA-256 before handlers see messages
+    --hash-secret file           hash with HMAC-SHA256 keyed with the contents of file
+    --route rule                 only pass messages matching a rule to its handlers, for example 'type == "track" => list'
     --topic name                 nsq consumer topic name
     --channel name               nsq consumer channel name [default: nsq_to_redis]
     --level name                 log level [default: info]
@@ -85,11 +160,6 @@ func main() {
 	}
 	metrics.Prefix(args["--statsd-prefix"].(string))
 
-	idleTimeout, err := time.ParseDuration(args["--idle-timeout"].(string))
-	if err != nil {
-		log.Fatalf("error parsing idle timeout: %s", err)
-	}
-
 	flushInterval, err := time.ParseDuration(args["--flush-interval"].(string))
 	if err != nil {
 		log.Fatalf("error parsing flush-interval: %s", err)
@@ -98,29 +168,62 @@ func main() {
 		log.Fatalf("flush-interval must not be a negative value")
 	}
 
-	maxIdle, err := strconv.Atoi(args["--max-idle"].(string))
+	flushMaxCommands, err := strconv.Atoi(args["--flush-max-commands"].(string))
 	if err != nil {
-		log.Fatalf("error parsing max-idle: %s", err)
+		log.Fatalf("error parsing flush-max-commands: %s", err)
+	}
+	if flushMaxCommands < 0 {
+		log.Fatalf("flush-max-commands must not be a negative value")
+	}
+
+	flushMaxBytes, err := strconv.Atoi(args["--flush-max-bytes"].(string))
+	if err != nil {
+		log.Fatalf("error parsing flush-max-bytes: %s", err)
 	}
-	if maxIdle > 100 {
-		log.Fatalf("max-idle must be below 100")
+	if flushMaxBytes < 0 {
+		log.Fatalf("flush-max-bytes must not be a negative value")
 	}
 
-	pool := &redis.Pool{
-		IdleTimeout:  idleTimeout,
-		MaxIdle:      maxIdle,
-		MaxActive:    100,
-		Dial:         dial(args["--redis-address"].(string)),
-		TestOnBorrow: ping,
+	pipelines, err := strconv.Atoi(args["--pipelines"].(string))
+	if err != nil {
+		log.Fatalf("error parsing pipelines: %s", err)
+	}
+	if pipelines < 1 {
+		log.Fatalf("pipelines must be at least 1")
+	}
+	if pipelines > 1 && args["--atomic"].(bool) {
+		log.Fatalf("atomic can't be used with several pipelines")
 	}
 
+	maxIdle, err := strconv.Atoi(args["--max-idle"].(string))
+	if err != nil {
+		log.Fatalf("error parsing max-idle: %s", err)
+	}
+
+	db := database(args, "--redis-db")
+	pool := redisPool(args, maxIdle, db)
+
+	maxMessageBytes, truncate, deadLetter := oversize(args, metrics)
+
 	broadcast := broadcast.New(&broadcast.Options{
-		Redis:         pool,
-		Metrics:       metrics,
-		Log:           log.Log,
-		Ratelimiter:   ratelimiter(args),
-		RatelimitKey:  args["--ratelimit-key"].(string),
-		FlushInterval: flushInterval,
+		Topic:            topic,
+		Channel:          channel,
+		Redis:            pool,
+		Metrics:          metrics,
+		Log:              log.Log,
+		Ratelimiter:      ratelimiter(args),
+		RatelimitKey:     args["--ratelimit-key"].(string),
+		Decoder:          decoder(args),
+		Filter:           expr(args, "--filter"),
+		Transformers:     transformers(args),
+		FlushInterval:    flushInterval,
+		FlushMaxCommands: flushMaxCommands,
+		FlushMaxBytes:    flushMaxBytes,
+		Pipelines:        pipelines,
+		Atomic:           args["--atomic"].(bool),
+		MaxMessageBytes:  maxMessageBytes,
+		Truncate:         truncate,
+		DeadLetter:       deadLetter,
 	})
 	config := config(args)
 
@@ -130,21 +233,30 @@ func main() {
 	}
 
 	log.SetLevelString(args["--level"].(string))
+	doc := templateSample(args)
+	sanitizer := sanitizer(args)
+
+	var handlers []handler
 
 	// Pub/Sub support.
 	if format, ok := args["--publish"].(string); ok {
 		log.Info("publishing to %q", format)
+		renderSample(format, doc, sanitizer)
+		metadataOnly(args, "--publish", variables(format))
 		pubsub, err := pubsub.New(&pubsub.Options{
-			Format:  format,
-			Log:     log.Log,
-			Metrics: metrics,
+			Format:    format,
+			Log:       log.Log,
+			Metrics:   metrics,
+			Strict:    args["--strict"].(bool),
+			Sanitizer: sanitizer,
+			Payload:   payloadFormat(args, "publish"),
 		})
 
 		if err != nil {
 			log.Fatalf("error starting pubsub: %s", err)
 		}
 
-		broadcast.Add(pubsub)
+		handlers = append(handlers, handler{"publish", pool, filtered(broadcast, args, "publish", pubsub)})
 	}
 
 	// Capped list support.
@@ -155,18 +267,45 @@ func main() {
 		}
 
 		log.Info("listing to %q (size=%d)", format, size)
+		renderSample(format, doc, sanitizer)
+		metadataOnly(args, "--list", variables(format))
 		list, err := list.New(&list.Options{
-			Format:  format,
-			Log:     log.Log,
-			Metrics: metrics,
-			Size:    int64(size),
+			Format:    format,
+			Log:       log.Log,
+			Metrics:   metrics,
+			Size:      int64(size),
+			Strict:    args["--strict"].(bool),
+			Sanitizer: sanitizer,
+			Payload:   payloadFormat(args, "list"),
 		})
 
 		if err != nil {
 			log.Fatalf("error starting list: %s", err)
 		}
 
-		broadcast.Add(list)
+		listPool := pool
+		if _, ok := args["--list-db"].(string); ok {
+			if listDB := database(args, "--list-db"); listDB != db {
+				// transactions are per database, a message could
+				// be committed to one and fail in the other
+				if args["--atomic"].(bool) {
+					log.Fatalf("atomic can't be used with a --list-db other than --redis-db")
+				}
+				log.Info("listing to database %d", listDB)
+				listPool = redisPool(args, maxIdle, listDB)
+			}
+		}
+
+		handlers = append(handlers, handler{"list", listPool, filtered(broadcast, args, "list", list)})
+	}
+
+	// Routing rules, without them every message goes to every handler.
+	if rules := args["--route"].([]string); len(rules) > 0 {
+		route(broadcast, args, rules, handlers)
+	} else {
+		for _, h := range handlers {
+			broadcast.AddTo(h.pool, h.Handler)
+		}
 	}
 
 	consumer.AddConcurrentHandlers(broadcast, maxIdle)
@@ -222,6 +361,10 @@ func ratelimiter(args map[string]interface{}) *ratelimit.Ratelimiter {
 		return nil
 	}
 
+	if key := args["--ratelimit-key"].(string); key != "" {
+		metadataOnly(args, "--ratelimit-key", []string{key})
+	}
+
 	keys, err := strconv.Atoi(args["--ratelimit-max-keys"].(string))
 	if err != nil {
 		log.Fatalf("error parsing --ratelimit-max-keys: %s", err)
@@ -230,10 +373,453 @@ func ratelimiter(args map[string]interface{}) *ratelimit.Ratelimiter {
 	return ratelimit.New(rate, keys)
 }
 
-// Dialer.
-func dial(addr string) func() (redis.Conn, error) {
+// Parse a filter expression from args, or nil.
+func expr(args map[string]interface{}, name string) broadcast.Predicate {
+	s, ok := args[name].(string)
+	if !ok {
+		return nil
+	}
+
+	e, err := filter.Parse(s)
+	if err != nil {
+		log.Fatalf("error parsing %s: %s", name, err)
+	}
+	metadataOnly(args, name, e.Variables())
+	return e
+}
+
+// Wrap h with the --<name>-sample sampler and
+// the --<name>-filter expression, if any.
+func filtered(b *broadcast.Broadcast, args map[string]interface{}, name string, h broadcast.Handler) broadcast.Handler {
+	if s := sampler(args, name); s != nil {
+		h = b.Filtered("sample."+name, s, h)
+	}
+
+	if p := expr(args, "--"+name+"-filter"); p != nil {
+		h = b.Filtered(name, p, h)
+	}
+
+	return h
+}
+
+// Parse the --<name>-sample and --<name>-sample-key
+// options from args and return a new sampler or nil.
+func sampler(args map[string]interface{}, name string) broadcast.Predicate {
+	s, ok := args["--"+name+"-sample"].(string)
+	if !ok {
+		return nil
+	}
+
+	rate, err := sample.ParseRate(s)
+	if err != nil {
+		log.Fatalf("error parsing --%s-sample: %s", name, err)
+	}
+
+	key, _ := args["--"+name+"-sample-key"].(string)
+	p, err := sample.New(rate, key)
+	if err != nil {
+		log.Fatalf("error parsing --%s-sample-key: %s", name, err)
+	}
+	if key != "" {
+		metadataOnly(args, "--"+name+"-sample-key", variables(key))
+	}
+
+	log.Info("sampling %s at %s", name, s)
+	return p
+}
+
+// handler is a named handler and the pool it writes to.
+type handler struct {
+	name string
+	pool *redis.Pool
+	broadcast.Handler
+}
+
+// Add routing rules in the format "expr => name,name" where names
+// are "list" or "publish", "*" matches every message. Each handler
+// is added once, matching the expressions of the rules naming it.
+func route(b *broadcast.Broadcast, args map[string]interface{}, rules []string, handlers []handler) {
+	predicates := make(map[string][]broadcast.Predicate)
+
+	for _, rule := range rules {
+		i := strings.LastIndex(rule, "=>")
+		if i < 0 {
+			log.Fatalf("error parsing --route %q: missing '=>'", rule)
+		}
+
+		var p broadcast.Predicate
+		if s := strings.TrimSpace(rule[:i]); s != "*" {
+			e, err := filter.Parse(s)
+			if err != nil {
+				log.Fatalf("error parsing --route %q: %s", rule, err)
+			}
+			metadataOnly(args, "--route", e.Variables())
+			p = e
+		}
+
+		for _, n := range strings.Split(rule[i+2:], ",") {
+			n = strings.TrimSpace(n)
+			found := false
+			for _, h := range handlers {
+				found = found || h.name == n
+			}
+			if !found {
+				log.Fatalf("error parsing --route %q: no %q handler, see --list and --publish", rule, n)
+			}
+			predicates[n] = append(predicates[n], p)
+		}
+
+		log.Info("routing %q", rule)
+	}
+
+	for _, h := range handlers {
+		if ps, ok := predicates[h.name]; ok {
+			b.RouteTo(h.pool, h.name, broadcast.Any(ps...), h.Handler)
+		}
+	}
+}
+
+// Parse input options from args and return
+// a decoder, or nil for JSON messages.
+func decoder(args map[string]interface{}) broadcast.Decoder {
+	switch name := args["--input"].(string); name {
+	case "json":
+		return nil
+	case "raw":
+		_, mask := args["--mask"].(string)
+		_, hash := args["--hash"].(string)
+		if mask || hash {
+			log.Fatalf("--mask and --hash can't be used with --input raw")
+		}
+		return input.Raw{}
+	case "msgpack":
+		return input.MessagePack{}
+	case "protobuf":
+		path, ok := args["--proto-descriptor"].(string)
+		message, _ := args["--proto-message"].(string)
+		if !ok || message == "" {
+			log.Fatalf("--input protobuf requires --proto-descriptor and --proto-message")
+		}
+
+		set, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatalf("error reading --proto-descriptor: %s", err)
+		}
+
+		p, err := input.NewProtobuf(set, message)
+		if err != nil {
+			log.Fatalf("error parsing --proto-descriptor: %s", err)
+		}
+		return p
+	default:
+		log.Fatalf("error parsing --input: unknown input %q", name)
+		return nil
+	}
+}
+
+// Check the option only references reserved variables with
+// --input raw, as raw messages have no fields.
+func metadataOnly(args map[string]interface{}, option string, vars []string) {
+	if args["--input"].(string) != "raw" {
+		return
+	}
+
+	for _, v := range vars {
+		if !strings.HasPrefix(v, "@") {
+			log.Fatalf("error parsing %s: raw messages have no %q field, only reserved variables such as @topic can be used", option, v)
+		}
+	}
+}
+
+// Return the variables of the template format.
+func variables(format string) []string {
+	tmpl, err := template.New(format)
+	if err != nil {
+		log.Fatalf("error parsing %q: %s", format, err)
+	}
+	return tmpl.Variables()
+}
+
+// Parse the message size options from args and return the maximum
+// size, and the truncator or dead letter handler of the policy.
+func oversize(args map[string]interface{}, metrics *statsd.Client) (int, broadcast.Transformer, broadcast.Handler) {
+	max, err := strconv.Atoi(args["--max-message-bytes"].(string))
+	if err != nil {
+		log.Fatalf("error parsing --max-message-bytes: %s", err)
+	}
+	if max < 0 {
+		log.Fatalf("max-message-bytes must not be a negative value")
+	}
+
+	switch policy := args["--oversize"].(string); policy {
+	case "skip":
+		return max, nil, nil
+	case "truncate":
+		path, ok := args["--truncate-field"].(string)
+		if !ok {
+			log.Fatalf("--oversize truncate requires --truncate-field")
+		}
+
+		t, err := payload.NewTruncator(path, max)
+		if err != nil {
+			log.Fatalf("error parsing --truncate-field: %s", err)
+		}
+		metadataOnly(args, "--truncate-field", []string{path})
+		return max, t, nil
+	case "dead-letter":
+		format, ok := args["--dead-letter"].(string)
+		if !ok {
+			log.Fatalf("--oversize dead-letter requires --dead-letter")
+		}
+
+		size, err := strconv.Atoi(args["--dead-letter-size"].(string))
+		if err != nil {
+			log.Fatalf("error parsing --dead-letter-size: %s", err)
+		}
+
+		log.Info("dead lettering messages over %d bytes to %q (size=%d)", max, format, size)
+		l, err := list.New(&list.Options{
+			Format:  format,
+			Log:     log.Log,
+			Metrics: metrics,
+			Size:    int64(size),
+			Payload: &payload.Format{Envelope: true},
+		})
+		if err != nil {
+			log.Fatalf("error parsing --dead-letter: %s", err)
+		}
+		return max, nil, l
+	default:
+		log.Fatalf("error parsing --oversize: unknown policy %q", policy)
+		return 0, nil, nil
+	}
+}
+
+// Parse redaction options from args and return the transformers.
+func transformers(args map[string]interface{}) []broadcast.Transformer {
+	mask, _ := args["--mask"].(string)
+	hash, _ := args["--hash"].(string)
+	if mask == "" && hash == "" {
+		return nil
+	}
+
+	var secret []byte
+	if path, ok := args["--hash-secret"].(string); ok {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatalf("error reading --hash-secret: %s", err)
+		}
+		secret = bytes.TrimRight(b, "\r\n")
+		if len(secret) == 0 {
+			log.Fatalf("--hash-secret %s is empty", path)
+		}
+	}
+
+	r, err := payload.NewRedactor(payload.ParsePaths(mask), payload.ParsePaths(hash), secret)
+	if err != nil {
+		log.Fatalf("error parsing --mask or --hash: %s", err)
+	}
+	return []broadcast.Transformer{r}
+}
+
+// Parse the --<name>-keep, --<name>-drop, --<name>-envelope and
+// --<name>-encoding options from args and return a new payload format
+// or nil.
+func payloadFormat(args map[string]interface{}, name string) *payload.Format {
+	encoding, err := payload.ParseEncoding(args["--"+name+"-encoding"].(string))
+	if err != nil {
+		log.Fatalf("error parsing --%s-encoding: %s", name, err)
+	}
+
+	f := &payload.Format{
+		Envelope: args["--"+name+"-envelope"].(bool),
+		Encoding: encoding,
+		Header:   args["--encoding-header"].(bool),
+	}
+
+	keep, _ := args["--"+name+"-keep"].(string)
+	drop, _ := args["--"+name+"-drop"].(string)
+	if keep != "" || drop != "" {
+		p, err := payload.NewProjection(payload.ParsePaths(keep), payload.ParsePaths(drop))
+		if err != nil {
+			log.Fatalf("error parsing --%s-keep or --%s-drop: %s", name, name, err)
+		}
+		f.Projection = p
+	}
+
+	if args["--input"].(string) == "raw" {
+		switch {
+		case f.Projection != nil || f.Envelope || f.Header:
+			log.Fatalf("--%s-keep, --%s-drop, --%s-envelope and --encoding-header can't be used with --input raw", name, name, name)
+		case f.Encoding == payload.MessagePack || f.Encoding == payload.CBOR:
+			log.Fatalf("--%s-encoding %s can't be used with --input raw", name, args["--"+name+"-encoding"])
+		}
+	}
+
+	if *f == (payload.Format{}) {
+		return nil
+	}
+	return f
+}
+
+// Parse key sanitization options from args
+// and return a new sanitizer or nil.
+func sanitizer(args map[string]interface{}) *template.Sanitizer {
+	n, err := strconv.Atoi(args["--max-key-length"].(string))
+	if err != nil {
+		log.Fatalf("error parsing --max-key-length: %s", err)
+	}
+	if n < 0 {
+		log.Fatalf("max-key-length must not be a negative value")
+	}
+	if n > 0 && n <= template.HashSuffixLength {
+		log.Fatalf("max-key-length must exceed %d", template.HashSuffixLength)
+	}
+
+	s := &template.Sanitizer{MaxLength: n}
+	if args["--sanitize-keys"].(bool) {
+		s.Replacement = '_'
+		s.Separator = ":"
+	}
+
+	if *s == (template.Sanitizer{}) {
+		return nil
+	}
+	return s
+}
+
+// Read the --template-sample document, or nil.
+func templateSample(args map[string]interface{}) []byte {
+	path, ok := args["--template-sample"].(string)
+	if !ok {
+		return nil
+	}
+
+	doc, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("error reading --template-sample: %s", err)
+	}
+	return doc
+}
+
+// Render format against the sample document so bad
+// templates fail on startup (a nil doc is skipped).
+func renderSample(format string, doc []byte, sanitizer *template.Sanitizer) {
+	if doc == nil {
+		return
+	}
+
+	tmpl, err := template.New(format)
+	if err != nil {
+		log.Fatalf("error parsing %q: %s", format, err)
+	}
+	tmpl.Sanitizer = sanitizer
+
+	keys, err := tmpl.Sample(string(doc))
+	if err != nil {
+		log.Fatalf("error rendering %q against --template-sample: %s", format, err)
+	}
+	log.Info("%q renders to %q", format, keys)
+}
+
+// Parse Redis configuration from args and return
+// a new connection pool selecting the given database.
+func redisPool(args map[string]interface{}, maxIdle, db int) *redis.Pool {
+	maxActive, err := strconv.Atoi(args["--max-active"].(string))
+	if err != nil {
+		log.Fatalf("error parsing --max-active: %s", err)
+	}
+	if maxActive < 0 {
+		log.Fatalf("max-active must not be a negative value")
+	}
+	if maxActive > 0 && maxIdle > maxActive {
+		log.Fatalf("max-idle must not exceed max-active")
+	}
+
+	return &redis.Pool{
+		IdleTimeout: duration(args, "--idle-timeout"),
+		MaxIdle:     maxIdle,
+		MaxActive:   maxActive,
+		Wait:        args["--wait"].(bool),
+		Dial: dial(args["--redis-address"].(string),
+			duration(args, "--dial-timeout"),
+			duration(args, "--keepalive"),
+			redis.DialReadTimeout(duration(args, "--read-timeout")),
+			redis.DialWriteTimeout(duration(args, "--write-timeout")),
+			redis.DialDatabase(db),
+		),
+		TestOnBorrow: test(duration(args, "--max-conn-lifetime")),
+	}
+}
+
+// Parse a redis database number from args.
+func database(args map[string]interface{}, name string) int {
+	db, err := strconv.Atoi(args[name].(string))
+	if err != nil {
+		log.Fatalf("error parsing %s: %s", name, err)
+	}
+	if db < 0 {
+		log.Fatalf("%s must not be a negative value", name)
+	}
+	return db
+}
+
+// Parse a non-negative duration from args.
+func duration(args map[string]interface{}, name string) time.Duration {
+	d, err := time.ParseDuration(args[name].(string))
+	if err != nil {
+		log.Fatalf("error parsing %s: %s", name, err)
+	}
+	if d < 0 {
+		log.Fatalf("%s must not be a negative value", name)
+	}
+	return d
+}
+
+// Dialer, addresses prefixed with
+// unix:// are dialed as unix sockets.
+func dial(addr string, timeout, keepalive time.Duration, options ...redis.DialOption) func() (redis.Conn, error) {
+	if keepalive == 0 {
+		keepalive = -1
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: keepalive,
+	}
+	options = append(options, redis.DialNetDial(dialer.Dial))
+
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix://") {
+		network = "unix"
+		addr = strings.TrimPrefix(addr, "unix://")
+	}
+
 	return func() (redis.Conn, error) {
-		return redis.Dial("tcp", addr)
+		c, err := redis.Dial(network, addr, options...)
+		if err != nil {
+			return nil, err
+		}
+		return &conn{Conn: c, created: time.Now()}, nil
+	}
+}
+
+// conn is a connection that knows when it was dialed.
+type conn struct {
+	redis.Conn
+	created time.Time
+}
+
+var errExpired = errors.New("connection exceeded its max lifetime")
+
+// Pooled connection test, connections older than
+// lifetime are closed (lifetime <= 0 disables).
+func test(lifetime time.Duration) func(redis.Conn, time.Time) error {
+	return func(client redis.Conn, t time.Time) error {
+		if c, ok := client.(*conn); ok && lifetime > 0 && time.Since(c.created) > lifetime {
+			return errExpired
+		}
+		return ping(client, t)
 	}
 }
 
@@ -0,0 +1,285 @@
+package payload
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+
+	"github.com/mreiferson/go-snappystream/snappy-go"
+)
+
+var ErrUnknownEncoding = errors.New("unknown encoding")
+
+// Encoding is the encoding of the values written to Redis. With
+// Format.Header, values are prefixed with the encoding as a byte.
+type Encoding byte
+
+// Encodings, their values are the header bytes.
+const (
+	JSON        Encoding = iota // JSON as is
+	MessagePack                 // MessagePack
+	CBOR                        // CBOR (RFC 7049)
+	Snappy                      // JSON compressed with snappy, block format
+	Gzip                        // JSON compressed with gzip
+	Zstd                        // JSON compressed with zstd
+)
+
+var encodings = []string{"json", "msgpack", "cbor", "snappy", "gzip", "zstd"}
+
+// ParseEncoding returns the encoding with the given name: "json",
+// "msgpack", "cbor", "snappy", "gzip" or "zstd".
+func ParseEncoding(name string) (Encoding, error) {
+	for i, s := range encodings {
+		if name == s {
+			return Encoding(i), nil
+		}
+	}
+	return JSON, ErrUnknownEncoding
+}
+
+// String returns the name of the encoding.
+func (e Encoding) String() string {
+	if int(e) < len(encodings) {
+		return encodings[e]
+	}
+	return "unknown"
+}
+
+// Encode encodes the JSON document doc.
+func (e Encoding) Encode(doc []byte) ([]byte, error) {
+	switch e {
+	case JSON:
+		return doc, nil
+	case MessagePack, CBOR:
+		d := json.NewDecoder(bytes.NewReader(doc))
+		d.UseNumber()
+		v, err := decode(d)
+		if err != nil {
+			return nil, err
+		}
+
+		var b bytes.Buffer
+		if e == MessagePack {
+			writeMsgpack(&b, v)
+		} else {
+			writeCBOR(&b, v)
+		}
+		return b.Bytes(), nil
+	case Snappy:
+		return snappy.Encode(nil, doc)
+	case Gzip:
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		if _, err := w.Write(doc); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	case Zstd:
+		return zstd(doc), nil
+	default:
+		return nil, ErrUnknownEncoding
+	}
+}
+
+// object is a decoded JSON object, in the order of its members.
+type object []member
+
+type member struct {
+	key   string
+	value interface{}
+}
+
+// decode decodes a JSON value to an object, []interface{},
+// string, json.Number, bool or nil.
+func decode(d *json.Decoder) (interface{}, error) {
+	t, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t {
+	case json.Delim('{'):
+		o := object{}
+		for d.More() {
+			k, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := decode(d)
+			if err != nil {
+				return nil, err
+			}
+			o = append(o, member{k.(string), v})
+		}
+		_, err = d.Token()
+		return o, err
+	case json.Delim('['):
+		a := []interface{}{}
+		for d.More() {
+			v, err := decode(d)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		_, err = d.Token()
+		return a, err
+	default:
+		return t, nil
+	}
+}
+
+// writeMsgpack writes a decoded JSON value as MessagePack.
+func writeMsgpack(b *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		b.WriteByte(0xc0)
+	case bool:
+		if v {
+			b.WriteByte(0xc3)
+		} else {
+			b.WriteByte(0xc2)
+		}
+	case json.Number:
+		n, err := v.Int64()
+		switch {
+		case err != nil:
+			f, _ := v.Float64()
+			b.WriteByte(0xcb)
+			writeUint(b, math.Float64bits(f), 8)
+		case n >= 0 && n < 128:
+			b.WriteByte(byte(n))
+		case n >= -32 && n < 0:
+			b.WriteByte(byte(n))
+		case n > 0:
+			writeMsgpackHead(b, 0xcc, uint64(n))
+		default:
+			b.WriteByte(0xd3)
+			writeUint(b, uint64(n), 8)
+		}
+	case string:
+		switch n := len(v); {
+		case n < 32:
+			b.WriteByte(0xa0 | byte(n))
+		case n <= math.MaxUint8:
+			b.WriteByte(0xd9)
+			b.WriteByte(byte(n))
+		default:
+			writeMsgpackHead(b, 0xd9, uint64(n))
+		}
+		b.WriteString(v)
+	case []interface{}:
+		if n := len(v); n < 16 {
+			b.WriteByte(0x90 | byte(n))
+		} else {
+			writeMsgpackHead(b, 0xdb, uint64(n))
+		}
+		for _, e := range v {
+			writeMsgpack(b, e)
+		}
+	case object:
+		if n := len(v); n < 16 {
+			b.WriteByte(0x80 | byte(n))
+		} else {
+			writeMsgpackHead(b, 0xdd, uint64(n))
+		}
+		for _, m := range v {
+			writeMsgpack(b, m.key)
+			writeMsgpack(b, m.value)
+		}
+	}
+}
+
+// writeMsgpackHead writes n in the smallest of the 16, 32 and 64 bit
+// forms following the type byte base, or in the 8 bit form of uints.
+func writeMsgpackHead(b *bytes.Buffer, base byte, n uint64) {
+	switch {
+	case n <= math.MaxUint8 && base == 0xcc:
+		b.WriteByte(base)
+		writeUint(b, n, 1)
+	case n <= math.MaxUint16:
+		b.WriteByte(base + 1)
+		writeUint(b, n, 2)
+	case n <= math.MaxUint32:
+		b.WriteByte(base + 2)
+		writeUint(b, n, 4)
+	default:
+		b.WriteByte(base + 3)
+		writeUint(b, n, 8)
+	}
+}
+
+// writeCBOR writes a decoded JSON value as CBOR.
+func writeCBOR(b *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		b.WriteByte(0xf6)
+	case bool:
+		if v {
+			b.WriteByte(0xf5)
+		} else {
+			b.WriteByte(0xf4)
+		}
+	case json.Number:
+		n, err := v.Int64()
+		switch {
+		case err != nil:
+			f, _ := v.Float64()
+			b.WriteByte(0xfb)
+			writeUint(b, math.Float64bits(f), 8)
+		case n >= 0:
+			writeCBORHead(b, 0, uint64(n))
+		default:
+			writeCBORHead(b, 1, uint64(-1-n))
+		}
+	case string:
+		writeCBORHead(b, 3, uint64(len(v)))
+		b.WriteString(v)
+	case []interface{}:
+		writeCBORHead(b, 4, uint64(len(v)))
+		for _, e := range v {
+			writeCBOR(b, e)
+		}
+	case object:
+		writeCBORHead(b, 5, uint64(len(v)))
+		for _, m := range v {
+			writeCBOR(b, m.key)
+			writeCBOR(b, m.value)
+		}
+	}
+}
+
+// writeCBORHead writes the initial bytes of
+// a data item of the given major type.
+func writeCBORHead(b *bytes.Buffer, major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		b.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		b.WriteByte(major | 24)
+		writeUint(b, n, 1)
+	case n <= math.MaxUint16:
+		b.WriteByte(major | 25)
+		writeUint(b, n, 2)
+	case n <= math.MaxUint32:
+		b.WriteByte(major | 26)
+		writeUint(b, n, 4)
+	default:
+		b.WriteByte(major | 27)
+		writeUint(b, n, 8)
+	}
+}
+
+// writeUint writes the size low bytes of n in big endian order.
+func writeUint(b *bytes.Buffer, n uint64, size int) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], n)
+	b.Write(buf[8-size:])
+}
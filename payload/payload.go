@@ -0,0 +1,229 @@
+// Package payload transforms the documents handlers write to Redis.
+package payload
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/segmentio/nsq_to_redis/broadcast"
+	"github.com/tidwall/gjson"
+)
+
+var (
+	ErrRawMessage      = errors.New("raw messages have no fields")
+	ErrInvalidPath     = errors.New("invalid path")
+	ErrUnsupportedPath = errors.New("wildcards and array queries are not supported")
+	ErrArrayPath       = errors.New("arrays can only be indexed by number")
+	ErrInvalidDocument = errors.New("invalid JSON document")
+)
+
+// Format describes the values written for messages.
+type Format struct {
+	Projection *Projection // Fields written, nil writes the whole message
+	Envelope   bool        // Wrap the message with its NSQ metadata
+	Encoding   Encoding    // Encoding of the value
+	Header     bool        // Prefix the value with its encoding
+}
+
+// envelope is a message wrapped with its NSQ metadata.
+type envelope struct {
+	ID           string          `json:"id"`
+	Topic        string          `json:"topic"`
+	Attempts     uint16          `json:"attempts"`
+	NSQTimestamp time.Time       `json:"nsq_timestamp"`
+	ReceivedAt   time.Time       `json:"received_at"`
+	Data         json.RawMessage `json:"data"`
+}
+
+// Encode returns the value written for m, its JSON when f is nil.
+// Raw messages can't be projected, their envelope holds the body as a
+// base64 string.
+func (f *Format) Encode(m *broadcast.Message) ([]byte, error) {
+	value := []byte(m.JSON)
+	if m.JSON == nil {
+		value = m.Body
+	}
+	if f == nil {
+		return value, nil
+	}
+
+	if f.Projection != nil {
+		if m.JSON == nil {
+			return nil, ErrRawMessage
+		}
+
+		var err error
+		if value, err = f.Projection.Apply(value); err != nil {
+			return nil, err
+		}
+	}
+
+	if f.Envelope {
+		data := json.RawMessage(value)
+		if m.JSON == nil {
+			b, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			data = b
+		}
+
+		var err error
+		value, err = json.Marshal(&envelope{
+			ID:           string(m.ID[:]),
+			Topic:        m.Topic,
+			Attempts:     m.Attempts,
+			NSQTimestamp: m.Timestamp.UTC(),
+			ReceivedAt:   m.ReceivedAt.UTC(),
+			Data:         data,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	value, err := f.Encoding.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Header {
+		value = append([]byte{byte(f.Encoding)}, value...)
+	}
+
+	return value, nil
+}
+
+// Projection selects the fields of a document. Kept fields remain at
+// the same path, `{"a":{"b":1,"c":2}}` projected to "a.b" is
+// `{"a":{"b":1}}`. Object keys are written in sorted order.
+type Projection struct {
+	keep []path
+	drop []path
+}
+
+// path is a gjson path and its components.
+type path struct {
+	raw  string
+	keys []string
+}
+
+// NewProjection returns a projection keeping the given paths, or the
+// whole document when there are none, then dropping the given paths.
+func NewProjection(keep, drop []string) (*Projection, error) {
+	p := new(Projection)
+
+	for _, s := range keep {
+		keys, err := split(s)
+		if err != nil {
+			return nil, err
+		}
+		p.keep = append(p.keep, path{s, keys})
+	}
+
+	for _, s := range drop {
+		keys, err := split(s)
+		if err != nil {
+			return nil, err
+		}
+		p.drop = append(p.drop, path{s, keys})
+	}
+
+	return p, nil
+}
+
+// ParsePaths parses a comma separated list of paths, optionally
+// in braces like a gjson multipath: "{userId,event,timestamp}".
+func ParsePaths(s string) []string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+		s = s[1 : len(s)-1]
+	}
+
+	var paths []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// Apply returns the projection of the JSON document doc.
+func (p *Projection) Apply(doc []byte) ([]byte, error) {
+	if len(p.keep) > 0 {
+		tree := make(map[string]interface{})
+		for _, path := range p.keep {
+			r := gjson.Get(string(doc), path.raw)
+			if r.Exists() {
+				set(tree, path.keys, json.RawMessage(r.Raw))
+			}
+		}
+
+		var err error
+		if doc, err = json.Marshal(tree); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, path := range p.drop {
+		var err error
+		if doc, err = remove(doc, path.keys); err != nil {
+			return nil, err
+		}
+	}
+
+	return doc, nil
+}
+
+// set sets the value at path in the tree.
+func set(tree map[string]interface{}, path []string, v json.RawMessage) {
+	for _, k := range path[:len(path)-1] {
+		child, ok := tree[k].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			tree[k] = child
+		}
+		tree = child
+	}
+	tree[path[len(path)-1]] = v
+}
+
+// remove removes the value at path from the JSON document doc.
+func remove(doc []byte, path []string) ([]byte, error) {
+	return update(doc, path, func(json.RawMessage) (json.RawMessage, bool) {
+		return nil, false
+	})
+}
+
+// split splits a gjson path into its keys.
+func split(s string) ([]string, error) {
+	var keys []string
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				b = append(b, s[i])
+			}
+		case '.':
+			keys = append(keys, string(b))
+			b = b[:0]
+		case '*', '?', '#':
+			return nil, ErrUnsupportedPath
+		default:
+			b = append(b, s[i])
+		}
+	}
+	keys = append(keys, string(b))
+
+	for _, k := range keys {
+		if k == "" {
+			return nil, ErrInvalidPath
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,415 @@
+package payload
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	nsq "github.com/bitly/go-nsq"
+	"github.com/bmizerany/assert"
+	"github.com/garyburd/redigo/redis"
+	"github.com/mreiferson/go-snappystream/snappy-go"
+	"github.com/segmentio/go-log"
+	"github.com/segmentio/nsq_to_redis/broadcast"
+	"github.com/segmentio/nsq_to_redis/broadcast/mocks"
+	statsd "github.com/segmentio/statsdclient"
+	"github.com/tidwall/gjson"
+)
+
+const doc = `{
+  "userId": "u",
+  "event": "Signed Up",
+  "timestamp": "2017-04-14T14:45:15.548Z",
+  "traits": {"email": "u@example.com", "name": "U"},
+  "context": {"ip": "10.0.0.1", "library": {"name": "analytics.js"}},
+  "fav.movie": "Deer Hunter"
+}`
+
+func TestProjection(t *testing.T) {
+	testCases := []struct {
+		keep     []string
+		drop     []string
+		expected string
+	}{
+		{[]string{"userId", "event"}, nil, `{"event":"Signed Up","userId":"u"}`},
+		{[]string{"userId", "missing"}, nil, `{"userId":"u"}`},
+		{[]string{"traits.email", "context.library.name"}, nil, `{"context":{"library":{"name":"analytics.js"}},"traits":{"email":"u@example.com"}}`},
+		{[]string{"traits"}, []string{"traits.email"}, `{"traits":{"name":"U"}}`},
+		{[]string{`fav\.movie`}, nil, `{"fav.movie":"Deer Hunter"}`},
+		{[]string{"userId", "context"}, []string{"context.ip", "missing.path"}, `{"context":{"library":{"name":"analytics.js"}},"userId":"u"}`},
+		{[]string{"userId"}, []string{"userId.nested"}, `{"userId":"u"}`},
+		{[]string{"missing"}, nil, `{}`},
+	}
+
+	for _, tc := range testCases {
+		p, err := NewProjection(tc.keep, tc.drop)
+		assert.Equal(t, nil, err)
+
+		got, err := p.Apply([]byte(doc))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, tc.expected, string(got))
+	}
+}
+
+func TestProjectionDrop(t *testing.T) {
+	p, err := NewProjection(nil, []string{"context", "traits.email", `fav\.movie`})
+	assert.Equal(t, nil, err)
+
+	got, err := p.Apply([]byte(doc))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{
+  "userId": "u",
+  "event": "Signed Up",
+  "timestamp": "2017-04-14T14:45:15.548Z",
+  "traits": {"name": "U"}
+}`, string(got))
+}
+
+func TestUpdate(t *testing.T) {
+	doc := []byte(`{"b":"<a&b>", "a" : {"x":1,"y.z":2}, "c":[{"d":1}]}`)
+
+	testCases := []struct {
+		path     []string
+		value    string
+		expected string
+	}{
+		{[]string{"a", "x"}, `"<>"`, `{"b":"<a&b>", "a" : {"x":"<>","y.z":2}, "c":[{"d":1}]}`},
+		{[]string{"a", "y.z"}, `3`, `{"b":"<a&b>", "a" : {"x":1,"y.z":3}, "c":[{"d":1}]}`},
+		{[]string{"b"}, "", `{"a" : {"x":1,"y.z":2}, "c":[{"d":1}]}`},
+		{[]string{"a"}, "", `{"b":"<a&b>", "c":[{"d":1}]}`},
+		{[]string{"c"}, "", `{"b":"<a&b>", "a" : {"x":1,"y.z":2}}`},
+		{[]string{"a", "y.z"}, "", `{"b":"<a&b>", "a" : {"x":1}, "c":[{"d":1}]}`},
+		{[]string{"c", "0"}, "", `{"b":"<a&b>", "a" : {"x":1,"y.z":2}, "c":[]}`},
+		{[]string{"c", "0", "d"}, `2`, `{"b":"<a&b>", "a" : {"x":1,"y.z":2}, "c":[{"d":2}]}`},
+		{[]string{"c", "1"}, "", string(doc)},
+		{[]string{"b", "x"}, "", string(doc)},
+		{[]string{"missing"}, "", string(doc)},
+	}
+
+	for _, tc := range testCases {
+		got, err := update(doc, tc.path, func(json.RawMessage) (json.RawMessage, bool) {
+			return json.RawMessage(tc.value), tc.value != ""
+		})
+		assert.Equal(t, nil, err)
+		assert.Equal(t, tc.expected, string(got))
+	}
+
+	got, err := remove([]byte(`{"a":{"b":1}}`), []string{"a", "b"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"a":{}}`, string(got))
+
+	got, err = remove([]byte(`{"a\\\"":1,"b":2}`), []string{`a\"`})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"b":2}`, string(got))
+
+	got, err = remove([]byte(`[1, 2, 3]`), []string{"1"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `[1, 3]`, string(got))
+
+	_, err = remove(doc, []string{"c", "d"})
+	assert.Equal(t, ErrArrayPath, err)
+
+	_, err = remove([]byte(`{"a":`), []string{"a"})
+	assert.Equal(t, ErrInvalidDocument, err)
+}
+
+func TestProjectionInvalid(t *testing.T) {
+	testCases := []struct {
+		path     string
+		expected error
+	}{
+		{"", ErrInvalidPath},
+		{"a..b", ErrInvalidPath},
+		{"a.", ErrInvalidPath},
+		{"items.#.name", ErrUnsupportedPath},
+		{"a*", ErrUnsupportedPath},
+		{"a?", ErrUnsupportedPath},
+	}
+
+	for _, tc := range testCases {
+		_, err := NewProjection([]string{tc.path}, nil)
+		assert.Equal(t, tc.expected, err)
+
+		_, err = NewProjection(nil, []string{tc.path})
+		assert.Equal(t, tc.expected, err)
+	}
+}
+
+func TestParsePaths(t *testing.T) {
+	assert.Equal(t, []string{"userId", "event", "timestamp"}, ParsePaths("{userId,event,timestamp}"))
+	assert.Equal(t, []string{"userId", "context.ip"}, ParsePaths(" userId, context.ip "))
+	assert.Equal(t, []string(nil), ParsePaths(""))
+	assert.Equal(t, []string(nil), ParsePaths("{}"))
+}
+
+func TestRedactor(t *testing.T) {
+	doc := `{"userId":"u","traits":{"email":"u@example.com","age":42,"phone":null},"context":{"ip":"10.0.0.1"}}`
+
+	r, err := NewRedactor([]string{"context.ip", "traits.phone", "missing"}, []string{"traits.email", "traits.age"}, nil)
+	assert.Equal(t, nil, err)
+
+	got, err := r.Redact([]byte(doc))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"userId":"u","traits":{"email":"7615aafcb45bcc853c4ed32cc5539842372555cd025f090746069db279a3d427",`+
+		`"age":"73475cb40a568e8da8a045ced110137e159f890ac4da883b6b17dc651b3a8049","phone":null},"context":{"ip":"[redacted]"}}`, string(got))
+
+	r, err = NewRedactor(nil, []string{"traits.email"}, []byte("secret"))
+	assert.Equal(t, nil, err)
+
+	got, err = r.Redact([]byte(doc))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "5c1aeb6538b7eab8dbc7813a0e1f07545c4302b467a55f671a658b6432f430fa", gjson.Get(string(got), "traits.email").String())
+	assert.Equal(t, "10.0.0.1", gjson.Get(string(got), "context.ip").String())
+
+	_, err = NewRedactor([]string{"items.#.email"}, nil, nil)
+	assert.Equal(t, ErrUnsupportedPath, err)
+
+	// every duplicate is redacted
+	r, err = NewRedactor([]string{"traits.email"}, nil, nil)
+	assert.Equal(t, nil, err)
+	got, err = r.Redact([]byte(`{"traits":{"email":"a@example.com","email":"b@example.com"}}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"traits":{"email":"[redacted]","email":"[redacted]"}}`, string(got))
+
+	// arrays are indexed, other paths through them fail
+	r, err = NewRedactor([]string{"items.1.email"}, nil, nil)
+	assert.Equal(t, nil, err)
+	got, err = r.Redact([]byte(`{"items":[{"email":"a@example.com"},{"email":"b@example.com"}]}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"items":[{"email":"a@example.com"},{"email":"[redacted]"}]}`, string(got))
+
+	r, err = NewRedactor([]string{"items.email"}, nil, nil)
+	assert.Equal(t, nil, err)
+	_, err = r.Redact([]byte(`{"items":[{"email":"a@example.com"}]}`))
+	assert.Equal(t, ErrArrayPath, err)
+}
+
+func TestRedactorTransform(t *testing.T) {
+	r, err := NewRedactor([]string{"email"}, nil, nil)
+	assert.Equal(t, nil, err)
+
+	m, err := broadcast.NewMessage("nsq_message_id_1", `{"email":"u@example.com"}`)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, r.Transform(m))
+	assert.Equal(t, `{"email":"[redacted]"}`, string(m.JSON))
+
+	raw := &broadcast.Message{Body: []byte("u@example.com")}
+	assert.Equal(t, ErrRawMessage, r.Transform(raw))
+}
+
+// handler records the documents of the messages it handles.
+type handler struct {
+	docs []string
+}
+
+func (h *handler) Handle(c broadcast.Conn, m *broadcast.Message) error {
+	h.docs = append(h.docs, string(m.JSON))
+	return nil
+}
+
+type pool struct{}
+
+func (pool) Get() redis.Conn { return mocks.NewNoOpRedisConn() }
+
+func TestRedactorDeadLetter(t *testing.T) {
+	r, err := NewRedactor([]string{"email"}, nil, nil)
+	assert.Equal(t, nil, err)
+
+	dead := &handler{}
+	b := broadcast.New(&broadcast.Options{
+		Redis:           pool{},
+		Metrics:         statsd.NewClient(ioutil.Discard),
+		Log:             log.Log,
+		Transformers:    []broadcast.Transformer{r},
+		MaxMessageBytes: 16,
+		DeadLetter:      dead,
+	})
+
+	msg := nsq.NewMessage(nsq.MessageID{}, []byte(`{"email":"u@example.com"}`))
+	assert.Equal(t, nil, b.HandleMessage(msg))
+	assert.Equal(t, []string{`{"email":"[redacted]"}`}, dead.docs)
+}
+
+func TestTruncator(t *testing.T) {
+	tr, err := NewTruncator("properties.body", 40)
+	assert.Equal(t, nil, err)
+
+	doc := []byte(`{"properties":{"body":"héllo world, héllo world"},"userId":"u"}`)
+	got, err := tr.Truncate(doc)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"properties":{"body":"h"},"userId":"u"}`, string(got))
+
+	got, err = tr.Truncate([]byte(`{"properties":{"body":[1,2,3,4,5,6,7,8,9,10,11,12]}}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"properties":{"body":null}}`, string(got))
+
+	got, err = tr.Truncate([]byte(`{"properties":{"body":"<b>a & b</b>\u2028<i>c</i>"}}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"properties":{"body":"<b>a & b</b"}}`, string(got))
+
+	small := []byte(`{"properties":{"body":"hi"}}`)
+	got, err = tr.Truncate(small)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, small, got)
+
+	m := &broadcast.Message{Body: doc}
+	assert.Equal(t, ErrRawMessage, tr.Transform(m))
+
+	_, err = NewTruncator("properties.*", 40)
+	assert.Equal(t, ErrUnsupportedPath, err)
+}
+
+func TestFormat(t *testing.T) {
+	m, err := broadcast.NewMessage("nsq_message_id_1", `{"userId":"u","event":"e"}`)
+	assert.Equal(t, nil, err)
+	m.Topic = "events"
+	m.Attempts = 2
+	m.Timestamp = time.Date(2017, 4, 14, 21, 49, 19, 0, time.UTC)
+	m.ReceivedAt = time.Date(2017, 4, 14, 21, 49, 19, 250000000, time.FixedZone("PDT", -7*3600))
+
+	var f *Format
+	got, err := f.Encode(m)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"userId":"u","event":"e"}`, string(got))
+
+	p, err := NewProjection([]string{"userId"}, nil)
+	assert.Equal(t, nil, err)
+
+	f = &Format{Projection: p}
+	got, err = f.Encode(m)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"userId":"u"}`, string(got))
+
+	f = &Format{Projection: p, Envelope: true}
+	got, err = f.Encode(m)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"id":"nsq_message_id_1","topic":"events","attempts":2,`+
+		`"nsq_timestamp":"2017-04-14T21:49:19Z","received_at":"2017-04-15T04:49:19.25Z",`+
+		`"data":{"userId":"u"}}`, string(got))
+
+	f = &Format{Projection: p, Encoding: CBOR, Header: true}
+	got, err = f.Encode(m)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "02a1667573657249646175", hex.EncodeToString(got))
+
+	raw := &broadcast.Message{Body: []byte("raw")}
+	_, err = f.Encode(raw)
+	assert.Equal(t, ErrRawMessage, err)
+}
+
+func TestFormatRaw(t *testing.T) {
+	var id nsq.MessageID
+	copy(id[:], "nsq_message_id_1")
+	m := &broadcast.Message{
+		ID:         id,
+		Topic:      "events",
+		Attempts:   1,
+		Timestamp:  time.Date(2017, 4, 14, 21, 49, 19, 0, time.UTC),
+		ReceivedAt: time.Date(2017, 4, 14, 21, 49, 19, 0, time.UTC),
+		Body:       []byte("<raw>"),
+	}
+
+	var f *Format
+	got, err := f.Encode(m)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "<raw>", string(got))
+
+	f = &Format{Encoding: Gzip, Header: true}
+	got, err = f.Encode(m)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, byte(Gzip), got[0])
+	r, err := gzip.NewReader(bytes.NewReader(got[1:]))
+	assert.Equal(t, nil, err)
+	got, err = ioutil.ReadAll(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "<raw>", string(got))
+
+	f = &Format{Envelope: true}
+	got, err = f.Encode(m)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"id":"nsq_message_id_1","topic":"events","attempts":1,`+
+		`"nsq_timestamp":"2017-04-14T21:49:19Z","received_at":"2017-04-14T21:49:19Z",`+
+		`"data":"PHJhdz4="}`, string(got))
+}
+
+func TestEncoding(t *testing.T) {
+	doc := []byte(`{"a":1,"b":[true,null],"c":-2.5,"d":"hi","e":-100,"f":300}`)
+
+	b, err := MessagePack.Encode(doc)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "86a16101a16292c3c0a163cbc004000000000000a164a26869"+
+		"a165d3ffffffffffffff9ca166cd012c", hex.EncodeToString(b))
+
+	b, err = CBOR.Encode(doc)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "a6616101616282f5f66163fbc0040000000000006164626869"+
+		"61653863616619012c", hex.EncodeToString(b))
+
+	b, err = Snappy.Encode(doc)
+	assert.Equal(t, nil, err)
+	b, err = snappy.Decode(nil, b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, doc, b)
+
+	b, err = Gzip.Encode(doc)
+	assert.Equal(t, nil, err)
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	assert.Equal(t, nil, err)
+	b, err = ioutil.ReadAll(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, doc, b)
+
+	b, err = Zstd.Encode([]byte(`{"a":"hello hello hello","b":"hello"}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "28b52ffd2025d50000907b2261223a2268656c6c6f20222c2262227d02003b09895192", hex.EncodeToString(b))
+
+	b, err = JSON.Encode(doc)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, doc, b)
+
+	_, err = MessagePack.Encode([]byte(`{"a":`))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestZstd(t *testing.T) {
+	testCases := []struct {
+		src      string
+		expected string
+	}{
+		{"", "28b52ffd2000010000"},               // empty raw block
+		{"abc", "28b52ffd2003190000616263"},      // raw block
+		{"aaaaaaaaaaaa", "28b52ffd200c63000061"}, // RLE block
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, hex.EncodeToString(zstd([]byte(tc.src))))
+	}
+
+	// blocks regenerate at most 128 kB, 256 kB take two
+	b := zstd(bytes.Repeat([]byte("ab"), zstdMaxBlock))
+	assert.Equal(t, "28b52ffda000000400", hex.EncodeToString(b[:9]))
+
+	var last []bool
+	for i := 9; i < len(b); {
+		h := int(b[i]) | int(b[i+1])<<8 | int(b[i+2])<<16
+		assert.Equal(t, zstdCompressed, h>>1&3)
+		last = append(last, h&1 == 1)
+		i += 3 + h>>3
+	}
+	assert.Equal(t, []bool{false, true}, last)
+}
+
+func TestParseEncoding(t *testing.T) {
+	for _, name := range []string{"json", "msgpack", "cbor", "snappy", "gzip", "zstd"} {
+		e, err := ParseEncoding(name)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, name, e.String())
+	}
+
+	_, err := ParseEncoding("lz4")
+	assert.Equal(t, ErrUnknownEncoding, err)
+}
@@ -0,0 +1,112 @@
+package payload
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+
+	"github.com/segmentio/nsq_to_redis/broadcast"
+	"github.com/tidwall/gjson"
+)
+
+// Mask is the value of masked fields.
+const Mask = "[redacted]"
+
+// Redactor masks or hashes fields of messages before handlers see them.
+type Redactor struct {
+	mask   []path
+	hash   []path
+	secret []byte
+}
+
+// NewRedactor returns a redactor replacing the fields at the mask paths
+// with Mask, and the fields at the hash paths with the hex SHA-256 of
+// their value, or its HMAC-SHA256 when a secret is given.
+func NewRedactor(mask, hash []string, secret []byte) (*Redactor, error) {
+	r := &Redactor{secret: secret}
+
+	for _, s := range mask {
+		keys, err := split(s)
+		if err != nil {
+			return nil, err
+		}
+		r.mask = append(r.mask, path{s, keys})
+	}
+
+	for _, s := range hash {
+		keys, err := split(s)
+		if err != nil {
+			return nil, err
+		}
+		r.hash = append(r.hash, path{s, keys})
+	}
+
+	return r, nil
+}
+
+// Transform implements broadcast.Transformer.
+func (r *Redactor) Transform(m *broadcast.Message) error {
+	if m.JSON == nil {
+		return ErrRawMessage
+	}
+
+	doc, err := r.Redact(m.JSON)
+	if err != nil {
+		return err
+	}
+
+	m.JSON = doc
+	return nil
+}
+
+// Redact returns the JSON document doc with its fields redacted,
+// null fields are left as is. It fails with ErrArrayPath rather
+// than leave fields in arrays which aren't indexed as they are.
+func (r *Redactor) Redact(doc []byte) ([]byte, error) {
+	mask, _ := json.Marshal(Mask)
+
+	for _, path := range r.mask {
+		var err error
+		doc, err = update(doc, path.keys, func(v json.RawMessage) (json.RawMessage, bool) {
+			if gjson.Parse(string(v)).Type == gjson.Null {
+				return v, true
+			}
+			return mask, true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, path := range r.hash {
+		var err error
+		doc, err = update(doc, path.keys, func(v json.RawMessage) (json.RawMessage, bool) {
+			res := gjson.Parse(string(v))
+			if res.Type == gjson.Null {
+				return v, true
+			}
+			sum, _ := json.Marshal(r.sum(res.String()))
+			return sum, true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return doc, nil
+}
+
+// sum returns the hex digest of s.
+func (r *Redactor) sum(s string) string {
+	var h hash.Hash
+	if r.secret != nil {
+		h = hmac.New(sha256.New, r.secret)
+	} else {
+		h = sha256.New()
+	}
+
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))
+}
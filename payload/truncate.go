@@ -0,0 +1,89 @@
+package payload
+
+import (
+	"bytes"
+	"encoding/json"
+	"unicode/utf8"
+
+	"github.com/segmentio/nsq_to_redis/broadcast"
+	"github.com/tidwall/gjson"
+)
+
+// Truncator shortens a large field of messages exceeding a size.
+type Truncator struct {
+	path path
+	max  int
+}
+
+// NewTruncator returns a truncator shortening the string at path so
+// that messages fit in max bytes, or replacing it with null if it
+// isn't a string.
+func NewTruncator(s string, max int) (*Truncator, error) {
+	keys, err := split(s)
+	if err != nil {
+		return nil, err
+	}
+	return &Truncator{path{s, keys}, max}, nil
+}
+
+// Transform implements broadcast.Transformer.
+func (t *Truncator) Transform(m *broadcast.Message) error {
+	if m.JSON == nil {
+		return ErrRawMessage
+	}
+
+	doc, err := t.Truncate(m.JSON)
+	if err != nil {
+		return err
+	}
+
+	m.JSON = doc
+	return nil
+}
+
+// Truncate returns the JSON document doc with the field shortened,
+// doc is returned as is if it fits. The result may still exceed the
+// size if the field is missing or too small.
+func (t *Truncator) Truncate(doc []byte) ([]byte, error) {
+	excess := len(doc) - t.max
+	if excess <= 0 {
+		return doc, nil
+	}
+
+	return update(doc, t.path.keys, func(v json.RawMessage) (json.RawMessage, bool) {
+		r := gjson.Parse(string(v))
+		if r.Type != gjson.String {
+			return json.RawMessage("null"), true
+		}
+
+		// escapes may differ from the original ones, so the string is
+		// shortened until its encoding fits
+		s := r.Str
+		size := len(v) - excess
+		n, over := len(s), excess
+		for {
+			n -= over
+			if n < 0 {
+				n = 0
+			}
+			for n > 0 && !utf8.RuneStart(s[n]) {
+				n--
+			}
+
+			b := encodeString(s[:n])
+			if over = len(b) - size; over <= 0 || n == 0 {
+				return b, true
+			}
+		}
+	})
+}
+
+// encodeString returns the JSON encoding of s, without escaping <, >
+// and & as json.Marshal does.
+func encodeString(s string) json.RawMessage {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n"))
+}
@@ -0,0 +1,239 @@
+package payload
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// update replaces the values at path in the JSON document doc with the
+// ones returned by fn, or removes them if fn returns false. Every member
+// of duplicate keys is updated, as readers differ on the one they use.
+// Array elements are addressed by their index, other keys fail with
+// ErrArrayPath. Values are spliced in, the rest of the document is left
+// untouched.
+func update(doc []byte, path []string, fn func(json.RawMessage) (json.RawMessage, bool)) ([]byte, error) {
+	values, err := find(doc, 0, 0, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// from the last value, so the bounds of the others hold
+	for i := len(values) - 1; i >= 0; i-- {
+		v := values[i]
+		raw, ok := fn(json.RawMessage(doc[v.start:v.end]))
+		start, end := v.start, v.end
+		if !ok {
+			start, end = v.bounds(doc)
+		}
+
+		out := make([]byte, 0, len(doc)-(end-start)+len(raw))
+		out = append(out, doc[:start]...)
+		out = append(out, raw...)
+		doc = append(out, doc[end:]...)
+	}
+
+	return doc, nil
+}
+
+// value is the position of a value in a document.
+type value struct {
+	key        int // start of its key, or of the value in arrays
+	start, end int
+}
+
+// bounds returns the bounds of the value with its key, and the
+// comma separating it from its neighbours.
+func (v value) bounds(doc []byte) (int, int) {
+	if i := skip(doc, v.end); i < len(doc) && doc[i] == ',' {
+		return v.key, skip(doc, i+1)
+	}
+	if i := skipBack(doc, v.key-1); doc[i] == ',' {
+		return i, v.end
+	}
+	return v.key, v.end
+}
+
+// find appends the values at path in the value starting at i,
+// whose key starts at k.
+func find(doc []byte, k, i int, path []string, values []value) ([]value, error) {
+	i = skip(doc, i)
+	end, err := skipValue(doc, i)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(path) == 0 {
+		return append(values, value{k, i, end}), nil
+	}
+
+	switch doc[i] {
+	case '{':
+		err = each(doc, i, func(key string, k, v int) error {
+			if key == path[0] {
+				values, err = find(doc, k, v, path[1:], values)
+			}
+			return err
+		})
+	case '[':
+		n, convErr := strconv.Atoi(path[0])
+		if convErr != nil || n < 0 {
+			return nil, ErrArrayPath
+		}
+
+		index := 0
+		err = each(doc, i, func(_ string, _, v int) error {
+			if index == n {
+				values, err = find(doc, v, v, path[1:], values)
+			}
+			index++
+			return err
+		})
+	}
+
+	return values, err
+}
+
+// each calls fn with the keys, and the start of the keys and values,
+// of the members of the object or the elements of the array at i.
+func each(doc []byte, i int, fn func(key string, k, v int) error) error {
+	closing := byte('}')
+	if doc[i] == '[' {
+		closing = ']'
+	}
+
+	i = skip(doc, i+1)
+	if i < len(doc) && doc[i] == closing {
+		return nil
+	}
+
+	for {
+		k, v := i, i
+		var key string
+		if closing == '}' {
+			end, err := skipString(doc, i)
+			if err != nil {
+				return err
+			}
+			if key, err = unquote(doc[i:end]); err != nil {
+				return err
+			}
+
+			i = skip(doc, end)
+			if i == len(doc) || doc[i] != ':' {
+				return ErrInvalidDocument
+			}
+			v = skip(doc, i+1)
+		}
+
+		if err := fn(key, k, v); err != nil {
+			return err
+		}
+
+		end, err := skipValue(doc, v)
+		if err != nil {
+			return err
+		}
+
+		switch i = skip(doc, end); {
+		case i == len(doc):
+			return ErrInvalidDocument
+		case doc[i] == ',':
+			i = skip(doc, i+1)
+		case doc[i] == closing:
+			return nil
+		default:
+			return ErrInvalidDocument
+		}
+	}
+}
+
+// unquote returns the value of the JSON string s.
+func unquote(s []byte) (string, error) {
+	if bytes.IndexByte(s, '\\') < 0 {
+		return string(s[1 : len(s)-1]), nil
+	}
+
+	var v string
+	if err := json.Unmarshal(s, &v); err != nil {
+		return "", ErrInvalidDocument
+	}
+	return v, nil
+}
+
+// skipValue returns the end of the value at i.
+func skipValue(doc []byte, i int) (int, error) {
+	if i >= len(doc) {
+		return 0, ErrInvalidDocument
+	}
+
+	switch doc[i] {
+	case '"':
+		return skipString(doc, i)
+	case '{', '[':
+		depth := 0
+		for ; i < len(doc); i++ {
+			switch doc[i] {
+			case '"':
+				end, err := skipString(doc, i)
+				if err != nil {
+					return 0, err
+				}
+				i = end - 1
+			case '{', '[':
+				depth++
+			case '}', ']':
+				if depth--; depth == 0 {
+					return i + 1, nil
+				}
+			}
+		}
+		return 0, ErrInvalidDocument
+	default:
+		start := i
+		for i < len(doc) && !isSpace(doc[i]) && doc[i] != ',' && doc[i] != '}' && doc[i] != ']' {
+			i++
+		}
+		if i == start {
+			return 0, ErrInvalidDocument
+		}
+		return i, nil
+	}
+}
+
+// skipString returns the end of the string at i.
+func skipString(doc []byte, i int) (int, error) {
+	if i >= len(doc) || doc[i] != '"' {
+		return 0, ErrInvalidDocument
+	}
+
+	for i++; i < len(doc); i++ {
+		switch doc[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1, nil
+		}
+	}
+	return 0, ErrInvalidDocument
+}
+
+// skip returns the index of the first non-whitespace byte from i.
+func skip(doc []byte, i int) int {
+	for i < len(doc) && isSpace(doc[i]) {
+		i++
+	}
+	return i
+}
+
+// skipBack returns the index of the last non-whitespace byte up to i.
+func skipBack(doc []byte, i int) int {
+	for i > 0 && isSpace(doc[i]) {
+		i--
+	}
+	return i
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
@@ -0,0 +1,408 @@
+package payload
+
+import "encoding/binary"
+
+// zstd compresses src into a single Zstandard frame (RFC 8878).
+// Matches are found with a hash table and their sequences coded
+// with the predefined FSE tables, literals are stored raw. Blocks
+// which don't compress are stored raw, or RLE when repeating a byte.
+func zstd(src []byte) []byte {
+	dst := make([]byte, 0, len(src)/2+32)
+	dst = zstdFrameHeader(dst, len(src))
+
+	z := &zstdEncoder{src: src}
+	for start := 0; ; start += zstdMaxBlock {
+		end := start + zstdMaxBlock
+		last := end >= len(src)
+		if last {
+			end = len(src)
+		}
+
+		dst = z.block(dst, start, end, last)
+		if last {
+			return dst
+		}
+	}
+}
+
+const (
+	zstdMagic    = 0xFD2FB528
+	zstdMaxBlock = 128 << 10
+	zstdMinMatch = 4
+	zstdHashLog  = 14
+)
+
+// zstdFrameHeader appends the header of a single segment frame
+// of size bytes, without checksum nor dictionary.
+func zstdFrameHeader(dst []byte, size int) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint32(b[:], zstdMagic)
+	dst = append(dst, b[:4]...)
+
+	const singleSegment = 1 << 5
+	switch {
+	case size < 256:
+		return append(dst, singleSegment, byte(size))
+	case size < 256+1<<16:
+		binary.LittleEndian.PutUint16(b[:], uint16(size-256))
+		return append(append(dst, 1<<6|singleSegment), b[:2]...)
+	case uint64(size) < 1<<32:
+		binary.LittleEndian.PutUint32(b[:], uint32(size))
+		return append(append(dst, 2<<6|singleSegment), b[:4]...)
+	default:
+		binary.LittleEndian.PutUint64(b[:], uint64(size))
+		return append(append(dst, 3<<6|singleSegment), b[:8]...)
+	}
+}
+
+// Block types.
+const (
+	zstdRaw = iota
+	zstdRLE
+	zstdCompressed
+)
+
+// zstdEncoder finds matches in src, which is the window
+// of the frame as it is a single segment.
+type zstdEncoder struct {
+	src   []byte
+	table [1 << zstdHashLog]int32 // last position+1 of each hash
+	seqs  []zstdSeq
+	lits  []byte
+}
+
+// zstdSeq is a sequence of literals followed by a match.
+type zstdSeq struct {
+	litLen   int
+	matchLen int
+	offset   int
+}
+
+// block appends the block of src[start:end].
+func (z *zstdEncoder) block(dst []byte, start, end int, last bool) []byte {
+	src := z.src[start:end]
+
+	if len(src) > 1 && repeated(src) {
+		dst = zstdBlockHeader(dst, zstdRLE, len(src), last)
+		return append(dst, src[0])
+	}
+
+	if body := z.compress(start, end); body != nil && len(body) < len(src) {
+		dst = zstdBlockHeader(dst, zstdCompressed, len(body), last)
+		return append(dst, body...)
+	}
+
+	dst = zstdBlockHeader(dst, zstdRaw, len(src), last)
+	return append(dst, src...)
+}
+
+// repeated returns true if b is a single repeated byte.
+func repeated(b []byte) bool {
+	for _, c := range b[1:] {
+		if c != b[0] {
+			return false
+		}
+	}
+	return true
+}
+
+func zstdBlockHeader(dst []byte, kind, size int, last bool) []byte {
+	h := kind<<1 | size<<3
+	if last {
+		h |= 1
+	}
+	return append(dst, byte(h), byte(h>>8), byte(h>>16))
+}
+
+// compress returns the content of a compressed block of
+// src[start:end], or nil if it has no matches.
+func (z *zstdEncoder) compress(start, end int) []byte {
+	z.seqs, z.lits = z.seqs[:0], z.lits[:0]
+
+	lit := start
+	for i := start; i+zstdMinMatch <= end; {
+		v := binary.LittleEndian.Uint32(z.src[i:])
+		h := v * 2654435761 >> (32 - zstdHashLog)
+		candidate := int(z.table[h]) - 1
+		z.table[h] = int32(i + 1)
+
+		if candidate < 0 || binary.LittleEndian.Uint32(z.src[candidate:]) != v {
+			i++
+			continue
+		}
+
+		n := zstdMinMatch
+		for i+n < end && z.src[candidate+n] == z.src[i+n] {
+			n++
+		}
+
+		z.lits = append(z.lits, z.src[lit:i]...)
+		z.seqs = append(z.seqs, zstdSeq{i - lit, n, i - candidate})
+		i += n
+		lit = i
+	}
+
+	if len(z.seqs) == 0 {
+		return nil
+	}
+	z.lits = append(z.lits, z.src[lit:end]...)
+
+	out := zstdLiterals(nil, z.lits)
+	out = zstdSequencesHeader(out, len(z.seqs))
+	return z.encodeSequences(out)
+}
+
+// zstdLiterals appends a raw literals section.
+func zstdLiterals(dst, lits []byte) []byte {
+	n := len(lits)
+	switch {
+	case n < 1<<5:
+		dst = append(dst, byte(n<<3))
+	case n < 1<<12:
+		dst = append(dst, byte(1<<2|n<<4), byte(n>>4))
+	default:
+		dst = append(dst, byte(3<<2|n<<4), byte(n>>4), byte(n>>12))
+	}
+	return append(dst, lits...)
+}
+
+// zstdSequencesHeader appends the number of sequences and their
+// compression modes, all predefined.
+func zstdSequencesHeader(dst []byte, n int) []byte {
+	switch {
+	case n < 0x80:
+		dst = append(dst, byte(n))
+	case n < 0x7F00:
+		dst = append(dst, byte(n>>8|0x80), byte(n))
+	default:
+		n -= 0x7F00
+		dst = append(dst, 0xFF, byte(n), byte(n>>8))
+	}
+	return append(dst, 0)
+}
+
+// encodeSequences appends the bitstream of the sequences, which
+// is read backwards, so the last sequence is written first.
+func (z *zstdEncoder) encodeSequences(dst []byte) []byte {
+	w := &bitWriter{out: dst}
+
+	var ll, ml, of fseState
+	for i := len(z.seqs) - 1; i >= 0; i-- {
+		s := z.seqs[i]
+		llCode, llExtra, llBits := zstdCode(zstdLitLenBase, zstdLitLenBits, s.litLen)
+		mlCode, mlExtra, mlBits := zstdCode(zstdMatchLenBase, zstdMatchLenBits, s.matchLen)
+
+		// offsets above 3 aren't repeat offsets
+		offset := uint32(s.offset + 3)
+		ofCode := uint8(highBit(offset))
+		ofExtra := offset - 1<<ofCode
+
+		if i == len(z.seqs)-1 {
+			ml.init(zstdMatchLenTable, mlCode)
+			of.init(zstdOffsetTable, ofCode)
+			ll.init(zstdLitLenTable, llCode)
+		} else {
+			of.encode(w, ofCode)
+			ml.encode(w, mlCode)
+			ll.encode(w, llCode)
+		}
+
+		w.add(uint64(llExtra), llBits)
+		w.add(uint64(mlExtra), mlBits)
+		w.add(uint64(ofExtra), uint(ofCode))
+	}
+
+	ml.flush(w)
+	of.flush(w)
+	ll.flush(w)
+	return w.close()
+}
+
+// zstdCode returns the code of v, its extra bits and their
+// number, given the baselines and extra bits of the codes.
+func zstdCode(base []uint32, bits []uint8, v int) (uint8, uint32, uint) {
+	c := len(base) - 1
+	for base[c] > uint32(v) {
+		c--
+	}
+	return uint8(c), uint32(v) - base[c], uint(bits[c])
+}
+
+func highBit(v uint32) int {
+	n := -1
+	for ; v != 0; v >>= 1 {
+		n++
+	}
+	return n
+}
+
+// Baselines and extra bits of literal length codes.
+var (
+	zstdLitLenBase = []uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512,
+		1024, 2048, 4096, 8192, 16384, 32768, 65536,
+	}
+	zstdLitLenBits = []uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+	}
+)
+
+// Baselines and extra bits of match length codes.
+var (
+	zstdMatchLenBase = []uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515,
+		1027, 2051, 4099, 8195, 16387, 32771, 65539,
+	}
+	zstdMatchLenBits = []uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+	}
+)
+
+// Predefined FSE tables of the sequence codes.
+var (
+	zstdLitLenTable = newFSETable(6, []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	})
+	zstdMatchLenTable = newFSETable(6, []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	})
+	zstdOffsetTable = newFSETable(5, []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	})
+)
+
+// fseTable is an FSE encoding table.
+type fseTable struct {
+	log     uint
+	states  []uint16
+	symbols []fseSymbol
+}
+
+// fseSymbol is how states are updated when encoding a symbol.
+type fseSymbol struct {
+	deltaBits  uint32
+	deltaState int32
+}
+
+// newFSETable builds the encoding table of a normalized distribution
+// where -1 is a probability lower than 1, as the decoder builds its own.
+func newFSETable(log uint, norm []int16) *fseTable {
+	size := 1 << log
+	t := &fseTable{
+		log:     log,
+		states:  make([]uint16, size),
+		symbols: make([]fseSymbol, len(norm)),
+	}
+
+	// low probability symbols take the last cells,
+	// others are spread over the remaining ones
+	spread := make([]int, size)
+	high := size - 1
+	cumul := make([]int, len(norm)+1)
+	for s, n := range norm {
+		if n == -1 {
+			spread[high] = s
+			high--
+			cumul[s+1] = cumul[s] + 1
+		} else {
+			cumul[s+1] = cumul[s] + int(n)
+		}
+	}
+
+	step := size>>1 + size>>3 + 3
+	pos := 0
+	for s, n := range norm {
+		for i := 0; i < int(n); i++ {
+			spread[pos] = s
+			for pos = (pos + step) & (size - 1); pos > high; pos = (pos + step) & (size - 1) {
+			}
+		}
+	}
+
+	for u, s := range spread {
+		t.states[cumul[s]] = uint16(size + u)
+		cumul[s]++
+	}
+
+	total := 0
+	for s, n := range norm {
+		switch n {
+		case 0:
+		case -1, 1:
+			t.symbols[s] = fseSymbol{uint32(log<<16) - uint32(size), int32(total - 1)}
+			total++
+		default:
+			maxBits := log - uint(highBit(uint32(n-1)))
+			minState := uint32(n) << maxBits
+			t.symbols[s] = fseSymbol{uint32(maxBits<<16) - minState, int32(total - int(n))}
+			total += int(n)
+		}
+	}
+
+	return t
+}
+
+// fseState is the state of an FSE encoder.
+type fseState struct {
+	value uint32
+	table *fseTable
+}
+
+// init sets the state to the one the decoder ends with for symbol s.
+func (f *fseState) init(t *fseTable, s uint8) {
+	sym := t.symbols[s]
+	bits := (sym.deltaBits + 1<<15) >> 16
+	v := bits<<16 - sym.deltaBits
+	*f = fseState{uint32(t.states[int32(v>>bits)+sym.deltaState]), t}
+}
+
+// encode writes the bits of the state preceding symbol s.
+func (f *fseState) encode(w *bitWriter, s uint8) {
+	sym := f.table.symbols[s]
+	bits := uint((f.value + sym.deltaBits) >> 16)
+	w.add(uint64(f.value), bits)
+	f.value = uint32(f.table.states[int32(f.value>>bits)+sym.deltaState])
+}
+
+// flush writes the initial state of the decoder.
+func (f *fseState) flush(w *bitWriter) {
+	w.add(uint64(f.value), f.table.log)
+}
+
+// bitWriter writes a little endian bitstream.
+type bitWriter struct {
+	out  []byte
+	bits uint64
+	n    uint
+}
+
+// add writes the n low bits of v.
+func (w *bitWriter) add(v uint64, n uint) {
+	w.bits |= (v & (1<<n - 1)) << w.n
+	for w.n += n; w.n >= 8; w.n -= 8 {
+		w.out = append(w.out, byte(w.bits))
+		w.bits >>= 8
+	}
+}
+
+// close ends the stream with a bit set, so the
+// decoder can find where its last byte starts.
+func (w *bitWriter) close() []byte {
+	w.add(1, 1)
+	if w.n > 0 {
+		w.out = append(w.out, byte(w.bits))
+	}
+	return w.out
+}
@@ -6,15 +6,19 @@ import (
 	"github.com/segmentio/go-log"
 	"github.com/segmentio/go-stats"
 	"github.com/segmentio/nsq_to_redis/broadcast"
+	"github.com/segmentio/nsq_to_redis/payload"
 	"github.com/segmentio/nsq_to_redis/template"
 	"github.com/segmentio/statsdclient"
 )
 
 // Options for PubSub.
 type Options struct {
-	Format  string         // Redis publish channel format
-	Log     *log.Logger    // Logger
-	Metrics *statsd.Client // Metrics
+	Format    string              // Redis publish channel format
+	Log       *log.Logger         // Logger
+	Metrics   *statsd.Client      // Metrics
+	Strict    bool                // Skip messages with missing or non-scalar fields
+	Sanitizer *template.Sanitizer // Key sanitizer, nil disables
+	Payload   *payload.Format     // Values written, nil writes the message as is
 }
 
 // PubSub publishes messages to a formatted channel.
@@ -36,6 +40,12 @@ func New(options *Options) (*PubSub, error) {
 		return nil, err
 	}
 
+	if err := tmpl.Validate(); err != nil {
+		return nil, err
+	}
+
+	tmpl.Sanitizer = p.Sanitizer
+	tmpl.Strict = p.Strict
 	p.template = tmpl
 	go p.stats.TickEvery(10 * time.Second)
 
@@ -44,27 +54,38 @@ func New(options *Options) (*PubSub, error) {
 
 // HandleMessage expects parsed json messages from NSQ,
 // applies them against the publish channel template to
-// produce the channel name, and then publishes to Redis.
+// produce the channel names, and then publishes to Redis.
 func (p *PubSub) Handle(c broadcast.Conn, msg *broadcast.Message) error {
 	start := time.Now()
 
-	channel, err := p.template.Eval(string(msg.JSON))
+	channels, err := p.template.EvalAll(msg.Context())
 	if err != nil {
+		p.Metrics.Incr("errors.template." + template.Reason(err))
 		p.Log.Error("evaluating template: %s", err)
 		return nil
 	}
 
-	p.Log.Info("publish %s to %s", msg.ID, channel)
-	p.Log.Debug("contents %s %s", msg.ID, msg.JSON)
-
-	err = c.Send("PUBLISH", channel, []byte(msg.JSON))
+	value, err := p.Payload.Encode(msg)
 	if err != nil {
-		p.Log.Error("publish: %s", err)
-		return err
+		p.Metrics.Incr("errors.payload")
+		p.Log.Error("encoding payload: %s", err)
+		return nil
+	}
+
+	for _, channel := range channels {
+		p.Log.Info("publish %s to %s", msg.ID, channel)
+		p.Log.Debug("contents %s %s", msg.ID, msg.JSON)
+
+		err = c.Send("PUBLISH", channel, value)
+		if err != nil {
+			p.Log.Error("publish: %s", err)
+			return err
+		}
+
+		p.Metrics.Incr("counts.published")
+		p.stats.Incr("published")
 	}
 
 	p.Metrics.Duration("timers.published", time.Since(start))
-	p.Metrics.Incr("counts.published")
-	p.stats.Incr("published")
 	return nil
 }
@@ -58,6 +58,26 @@ func TestPubSub(t *testing.T) {
 	assert.Equal(t, `{"projectId":"gy2d"}`, string(msg.Data))
 }
 
+func TestPubSubFanout(t *testing.T) {
+	pubSub, err := New(&Options{
+		Format:  "audiences:{audiences}",
+		Log:     log.Log.New("pubsub_test"),
+		Metrics: statsd.NewClient(ioutil.Discard),
+	})
+	assert.Equal(t, nil, err)
+
+	contents := `{"audiences":["a","b"]}`
+	conn := &mocks.Conn{}
+	for _, channel := range []string{"audiences:a", "audiences:b"} {
+		conn.On("Send", "PUBLISH", []interface{}{channel, []byte(contents)}).Return(nil).Once()
+	}
+
+	msg, err := broadcast.NewMessage("nsq_message_id_1", contents)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, pubSub.Handle(conn, msg))
+	conn.AssertExpectations(t)
+}
+
 func BenchmarkPubSub(b *testing.B) {
 	l := log.Log.New("pubsub_benchmark")
 	l.SetLevel(log.ERROR)
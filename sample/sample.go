@@ -0,0 +1,91 @@
+// Package sample provides predicates keeping a fraction of messages,
+// either at random or consistently by key, so that all the messages
+// of a user are either kept or dropped.
+package sample
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/segmentio/nsq_to_redis/broadcast"
+	"github.com/segmentio/nsq_to_redis/template"
+)
+
+var ErrInvalidRate = errors.New("rate must be between 0 and 1, or 0% and 100%")
+
+// Sampler keeps a fraction of messages.
+type Sampler struct {
+	rate float64
+	key  *template.T
+}
+
+// random returns a number in [0, 1).
+var random = rand.Float64
+
+// New returns a sampler keeping messages at the given rate, at random
+// when key is empty, otherwise by hashing the key template rendered for
+// each message.
+func New(rate float64, key string) (*Sampler, error) {
+	if math.IsNaN(rate) || rate < 0 || rate > 1 {
+		return nil, ErrInvalidRate
+	}
+
+	s := &Sampler{rate: rate}
+	if key != "" {
+		tmpl, err := template.New(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := tmpl.Validate(); err != nil {
+			return nil, err
+		}
+		s.key = tmpl
+	}
+
+	return s, nil
+}
+
+// ParseRate parses a rate such as "0.01" or "1%".
+func ParseRate(s string) (float64, error) {
+	div := 1.0
+	if strings.HasSuffix(s, "%") {
+		s = s[:len(s)-1]
+		div = 100
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	f /= div
+	if math.IsNaN(f) || f < 0 || f > 1 {
+		return 0, ErrInvalidRate
+	}
+	return f, nil
+}
+
+// Match implements broadcast.Predicate. Messages
+// whose key fails to render are dropped.
+func (s *Sampler) Match(m *broadcast.Message) bool {
+	if s.key == nil {
+		return random() < s.rate
+	}
+
+	k, err := s.key.EvalContext(m.Context())
+	if err != nil {
+		return false
+	}
+	return s.Keep(k)
+}
+
+// Keep returns true if the messages with the given key are kept.
+func (s *Sampler) Keep(key string) bool {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return float64(h.Sum64())/math.Exp2(64) < s.rate
+}
@@ -0,0 +1,90 @@
+package sample
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/segmentio/nsq_to_redis/broadcast"
+)
+
+func TestParseRate(t *testing.T) {
+	for s, want := range map[string]float64{
+		"0.01": 0.01,
+		"1%":   0.01,
+		"100%": 1,
+		"0":    0,
+	} {
+		rate, err := ParseRate(s)
+		assert.Equal(t, nil, err, s)
+		assert.Equal(t, want, rate, s)
+	}
+
+	for _, s := range []string{"", "%", "x", "1.5", "-1%", "101%"} {
+		_, err := ParseRate(s)
+		assert.NotEqual(t, nil, err, s)
+	}
+
+	for _, s := range []string{"NaN", "nan%"} {
+		_, err := ParseRate(s)
+		assert.Equal(t, ErrInvalidRate, err, s)
+	}
+}
+
+func TestSamplerRandom(t *testing.T) {
+	defer func(f func() float64) { random = f }(random)
+
+	values := []float64{0.05, 0.1, 0.5, 0.0999}
+	random = func() float64 {
+		v := values[0]
+		values = values[1:]
+		return v
+	}
+
+	s, err := New(0.1, "")
+	assert.Equal(t, nil, err)
+
+	m, err := broadcast.NewMessage("nsq_message_id_1", `{}`)
+	assert.Equal(t, nil, err)
+
+	var kept []bool
+	for i := 0; i < 4; i++ {
+		kept = append(kept, s.Match(m))
+	}
+	assert.Equal(t, []bool{true, false, false, true}, kept)
+}
+
+func TestSamplerKey(t *testing.T) {
+	s, err := New(0.1, "{userId}")
+	assert.Equal(t, nil, err)
+
+	kept := 0
+	for i := 0; i < 10000; i++ {
+		doc := fmt.Sprintf(`{"userId":"user-%d"}`, i)
+		m, err := broadcast.NewMessage("nsq_message_id_1", doc)
+		assert.Equal(t, nil, err)
+
+		k := s.Match(m)
+		if k {
+			kept++
+		}
+
+		// all the messages of a user are kept or dropped
+		m, _ = broadcast.NewMessage("nsq_message_id_2", doc)
+		assert.Equal(t, k, s.Match(m))
+	}
+
+	assert.T(t, kept > 900 && kept < 1100, kept)
+}
+
+func TestSamplerInvalid(t *testing.T) {
+	_, err := New(1.5, "")
+	assert.Equal(t, ErrInvalidRate, err)
+
+	_, err = New(math.NaN(), "")
+	assert.Equal(t, ErrInvalidRate, err)
+
+	_, err = New(0.5, "{userId")
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,145 @@
+package template
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnknownFilter   = errors.New("unknown filter")
+	ErrInvalidArgument = errors.New("invalid filter argument")
+	ErrInvalidTime     = errors.New("invalid time")
+)
+
+// value is the value of a variable as it
+// is passed through the filters.
+type value struct {
+	str    string
+	exists bool
+}
+
+// filter transforms a value.
+type filter func(value) (value, error)
+
+// newFilter returns the filter with the given name and argument.
+func newFilter(name, arg string) (filter, error) {
+	switch name {
+	case "lower":
+		return strfilter(strings.ToLower), nil
+	case "upper":
+		return strfilter(strings.ToUpper), nil
+	case "trim":
+		return strfilter(strings.TrimSpace), nil
+	case "md5":
+		return strfilter(func(s string) string {
+			sum := md5.Sum([]byte(s))
+			return hex.EncodeToString(sum[:])
+		}), nil
+	case "sha1":
+		return strfilter(func(s string) string {
+			sum := sha1.Sum([]byte(s))
+			return hex.EncodeToString(sum[:])
+		}), nil
+	case "sha256":
+		return strfilter(func(s string) string {
+			sum := sha256.Sum256([]byte(s))
+			return hex.EncodeToString(sum[:])
+		}), nil
+	case "hashtag":
+		return strfilter(func(s string) string {
+			return "{" + s + "}"
+		}), nil
+	case "truncate":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 {
+			return nil, ErrInvalidArgument
+		}
+		return strfilter(func(s string) string {
+			return truncate(s, n)
+		}), nil
+	case "default":
+		return func(v value) (value, error) {
+			if !v.exists || v.str == "" {
+				return value{str: arg, exists: true}, nil
+			}
+			return v, nil
+		}, nil
+	case "time":
+		if arg == "" {
+			return nil, ErrInvalidArgument
+		}
+		return func(v value) (value, error) {
+			if !v.exists {
+				return v, nil
+			}
+			t, err := parseTime(v.str)
+			if err != nil {
+				return v, err
+			}
+			v.str = t.UTC().Format(arg)
+			return v, nil
+		}, nil
+	default:
+		return nil, ErrUnknownFilter
+	}
+}
+
+// strfilter returns a filter applying fn to the value.
+func strfilter(fn func(string) string) filter {
+	return func(v value) (value, error) {
+		v.str = fn(v.str)
+		return v, nil
+	}
+}
+
+// Layouts of timestamps parsed by the time filter.
+var layouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z0700",
+}
+
+// parseTime parses an RFC3339 timestamp, or a number
+// of seconds or milliseconds since the epoch. Numbers
+// above 1e11 are taken as milliseconds.
+func parseTime(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if n > 1e11 {
+			return time.Unix(0, n*int64(time.Millisecond)), nil
+		}
+		return time.Unix(n, 0), nil
+	}
+
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		if n > 1e11 {
+			n /= 1e3
+		}
+		sec, frac := math.Modf(n)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, ErrInvalidTime
+}
+
+// truncate returns the first n characters of s.
+func truncate(s string, n int) string {
+	for i := range s {
+		if n == 0 {
+			return s[:i]
+		}
+		n--
+	}
+	return s
+}
@@ -0,0 +1,71 @@
+package template
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var ErrEmptySegment = errors.New("empty key segment")
+
+// HashSuffixLength is the length of the suffix
+// replacing the end of keys exceeding MaxLength.
+const HashSuffixLength = 17
+
+// Sanitizer post-processes rendered keys so a malformed
+// value can't produce pathological keys in Redis.
+type Sanitizer struct {
+	Replacement rune   // Replaces whitespace and control characters, 0 keeps them
+	Separator   string // Rejects keys with empty segments, "" allows them
+	MaxLength   int    // Shortens longer keys to MaxLength bytes, 0 is unlimited
+}
+
+// Sanitize returns the sanitized key, or ErrEmptySegment. Keys
+// longer than MaxLength are cut and end with "~" and a hash of
+// the whole key so they remain distinct.
+func (s *Sanitizer) Sanitize(key string) (string, error) {
+	if s.Replacement != 0 {
+		key = strings.Map(func(r rune) rune {
+			if unicode.IsSpace(r) || unicode.IsControl(r) {
+				return s.Replacement
+			}
+			return r
+		}, key)
+	}
+
+	if s.Separator != "" && emptySegment(key, s.Separator) {
+		return "", ErrEmptySegment
+	}
+
+	if s.MaxLength > 0 && len(key) > s.MaxLength {
+		sum := sha256.Sum256([]byte(key))
+		n := s.MaxLength - HashSuffixLength
+		if n < 0 {
+			n = 0
+		}
+		for n > 0 && !utf8.RuneStart(key[n]) {
+			n--
+		}
+		key = key[:n] + "~" + hex.EncodeToString(sum[:])[:HashSuffixLength-1]
+	}
+
+	return key, nil
+}
+
+// emptySegment returns true if a segment
+// of key between separators is empty.
+func emptySegment(key, sep string) bool {
+	for {
+		i := strings.Index(key, sep)
+		switch {
+		case i == 0:
+			return true
+		case i < 0:
+			return key == ""
+		}
+		key = key[i+len(sep):]
+	}
+}
@@ -5,19 +5,139 @@
 // and data `{"foo": "f", "bar": b}`, eval returns "f:b".
 // It allows nested variables. Given the format "foo:{bar.baz}" and data
 // and data `{"bar": { "baz" : "b"}}`, eval returns "foo:b".
+// Variables can be piped through filters. Given the format "foo:{bar|upper}"
+// and data `{"bar":"b"}`, eval returns "foo:B".
+// Variables can fall back to alternatives. Given the format "{foo||bar}"
+// and data `{"bar":"b"}`, eval returns "b".
+// Sections in brackets are only rendered if their variables are not empty.
+// Given the format "foo[:{bar}]" and data `{}`, eval returns "foo".
+// Literal braces and brackets are escaped by doubling them, "{{foo}}"
+// evaluates to "{foo}". Inside a section "]" always closes it.
 package template
 
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/tidwall/gjson"
 )
 
-var ErrMissingClosingBrace = errors.New("missing '}'")
+var (
+	ErrMissingClosingBrace   = errors.New("missing '}'")
+	ErrMissingClosingBracket = errors.New("missing ']'")
+	ErrNestedSection         = errors.New("nested '['")
+	ErrMissingField          = errors.New("missing field")
+	ErrNonScalar             = errors.New("object or array value")
+	ErrUnknownVariable       = errors.New("unknown reserved variable")
+	ErrEmptyVariable         = errors.New("empty variable")
+	ErrInvalidPath           = errors.New("invalid path")
+	ErrDuplicateVariable     = errors.New("duplicate variable")
+)
+
+// Error is an error about a variable of the template.
+type Error struct {
+	Variable string
+	Err      error
+}
+
+// Error implements error.
+func (e *Error) Error() string {
+	return fmt.Sprintf("template: {%s}: %s", e.Variable, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Reason returns a short description of err suitable for metrics:
+// "missing_field", "non_scalar", "empty_segment" or "invalid".
+func Reason(err error) string {
+	if err == ErrEmptySegment {
+		return "empty_segment"
+	}
+	if e, ok := err.(*Error); ok {
+		switch e.Err {
+		case ErrMissingField:
+			return "missing_field"
+		case ErrNonScalar:
+			return "non_scalar"
+		}
+	}
+	return "invalid"
+}
+
+// Context is what a template is evaluated against, a JSON
+// document and the values of reserved variables such as
+// {@topic}, keyed by their name without the "@". A context
+// caches lookups and must not be used concurrently.
+type Context struct {
+	JSON []byte
+	Vars map[string]string
+
+	cache []cached
+	buf   [8]cached // backs cache for the first lookups
+}
+
+// cached is the result of a lookup.
+type cached struct {
+	path   string
+	result gjson.Result
+}
+
+// Get returns the value at path in the JSON document. Results are
+// cached, so templates evaluated against the same context scan
+// the document once per path.
+func (c *Context) Get(path string) gjson.Result {
+	for _, e := range c.cache {
+		if e.path == path {
+			return e.result
+		}
+	}
+
+	if c.cache == nil {
+		c.cache = c.buf[:0]
+	}
+	r := gjson.GetBytes(c.JSON, path)
+	c.cache = append(c.cache, cached{path, r})
+	return r
+}
+
+// buffers holds the buffers templates are rendered into.
+var buffers = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// Reserved lists the names of reserved variables. Except for
+// "now", their values are supplied through the Context.
+var Reserved = []string{
+	"now",
+	"topic",
+	"channel",
+	"id",
+	"attempts",
+	"nsqd",
+	"timestamp",
+}
 
 type T struct {
 	nodes []node
+	vars  []node // variable nodes, including the ones in sections
+
+	// Strict makes Eval fail with ErrMissingField when a variable
+	// is missing or null, and ErrNonScalar when it is an object or
+	// an array, instead of rendering them as is. EvalAll still fans
+	// out arrays, but fails the same way on their elements.
+	Strict bool
+
+	// Sanitizer, when set, post-processes the rendered results.
+	Sanitizer *Sanitizer
 }
 
 // Returns a new template.
@@ -25,27 +145,53 @@ func New(format string) (*T, error) {
 	var b bytes.Buffer
 	state := sLiteral
 	var nodes []node
+	var outer []node
+	section := false
 
 	for i := 0; i < len(format); i++ {
 		c := format[i]
 		switch state {
 		case sLiteral:
-			switch c {
-			case '{':
+			switch {
+			// "]" closes a section before "]]" is unescaped,
+			// so "[{a}]]" is a section followed by "]".
+			case c == ']' && section:
+				nodes = append(nodes, node{
+					literal: b.String(),
+				})
+				b.Reset()
+				outer, nodes = nil, append(outer, node{section: nodes})
+				section = false
+			case escapable(c) && i+1 < len(format) && format[i+1] == c:
+				b.WriteByte(c)
+				i++
+			case c == '{':
 				nodes = append(nodes, node{
 					literal: b.String(),
 				})
 				b.Reset()
 				state = sVariable
+			case c == '[':
+				if section {
+					return nil, ErrNestedSection
+				}
+				nodes = append(nodes, node{
+					literal: b.String(),
+				})
+				b.Reset()
+				outer, nodes = nodes, nil
+				section = true
 			default:
 				b.WriteByte(c)
 			}
 		case sVariable:
 			switch c {
 			case '}':
-				nodes = append(nodes, node{
-					variable: b.String(),
-				})
+				n, err := parseVariable(b.String())
+				if err != nil {
+					return nil, err
+				}
+				nodes = append(nodes, n)
 				b.Reset()
 				state = sLiteral
 				break
@@ -59,13 +205,59 @@ func New(format string) (*T, error) {
 		return nil, ErrMissingClosingBrace
 	}
 
+	if section {
+		return nil, ErrMissingClosingBracket
+	}
+
 	if b.Len() != 0 {
 		nodes = append(nodes, node{
 			literal: b.String(),
 		})
 	}
 
-	return &T{nodes}, nil
+	return &T{nodes: nodes, vars: variables(nodes)}, nil
+}
+
+// escapable returns true if c is escaped by doubling it.
+func escapable(c byte) bool {
+	return c == '{' || c == '}' || c == '[' || c == ']'
+}
+
+// parseVariable parses a variable in the format
+// "path||alternative|filter|filter:argument".
+func parseVariable(s string) (node, error) {
+	parts := strings.Split(s, "|")
+	n := node{expr: s, paths: []string{parts[0]}}
+
+	i := 1
+	for ; i+1 < len(parts) && parts[i] == ""; i += 2 {
+		n.paths = append(n.paths, parts[i+1])
+	}
+	n.variable = strings.Join(n.paths, "||")
+
+	for _, path := range n.paths {
+		if path == "" {
+			return node{}, &Error{s, ErrEmptyVariable}
+		}
+		if strings.HasPrefix(path, "@") && !reserved(path[1:]) {
+			return node{}, &Error{s, ErrUnknownVariable}
+		}
+	}
+
+	for _, part := range parts[i:] {
+		name, arg := part, ""
+		if i := strings.IndexByte(part, ':'); i >= 0 {
+			name, arg = part[:i], part[i+1:]
+		}
+
+		f, err := newFilter(name, arg)
+		if err != nil {
+			return node{}, &Error{s, err}
+		}
+		n.filters = append(n.filters, f)
+	}
+
+	return n, nil
 }
 
 const (
@@ -73,23 +265,416 @@ const (
 	sVariable
 )
 
+// reserved returns true if name is a reserved variable.
+func reserved(name string) bool {
+	for _, r := range Reserved {
+		if name == r {
+			return true
+		}
+	}
+	return false
+}
+
+// Variables returns the paths referenced by the template in order
+// of appearance, including alternatives and reserved variables
+// such as "@topic". Each path is only listed once.
+func (t *T) Variables() []string {
+	var vars []string
+	for _, n := range t.vars {
+		vars = append(vars, n.paths...)
+	}
+	return unique(vars)
+}
+
+// Validate checks the syntax of the paths referenced by the
+// template, and that no variable is repeated with the same filters.
+func (t *T) Validate() error {
+	seen := make(map[string]struct{})
+	for _, n := range t.vars {
+		for _, path := range n.paths {
+			if !strings.HasPrefix(path, "@") && !validPath(path) {
+				return &Error{n.expr, ErrInvalidPath}
+			}
+		}
+
+		if _, ok := seen[n.expr]; ok {
+			return &Error{n.expr, ErrDuplicateVariable}
+		}
+		seen[n.expr] = struct{}{}
+	}
+	return nil
+}
+
+// Sample renders the template against a JSON document as a
+// strict template would, regardless of Strict. It returns
+// the keys a message like data would be written to.
+func (t *T) Sample(data string) ([]string, error) {
+	strict := *t
+	strict.Strict = true
+	return strict.EvalAll(&Context{JSON: []byte(data)})
+}
+
+// variables returns the variable nodes,
+// including the ones in sections.
+func variables(nodes []node) []node {
+	var vars []node
+	for _, n := range nodes {
+		for _, c := range n.section {
+			if c.variable != "" {
+				vars = append(vars, c)
+			}
+		}
+		if n.variable != "" {
+			vars = append(vars, n)
+		}
+	}
+	return vars
+}
+
+// validPath returns true if path is a well formed gjson path:
+// dot separated non-empty components, escapes followed by a
+// character and balanced query brackets.
+func validPath(path string) bool {
+	depth := 0
+	size := 0
+	for i := 0; i < len(path); i++ {
+		switch path[i] {
+		case '\\':
+			if i+1 == len(path) {
+				return false
+			}
+			i++
+		case '[', '(':
+			depth++
+		case ']', ')':
+			depth--
+			if depth < 0 {
+				return false
+			}
+		case '.':
+			if depth > 0 {
+				break
+			}
+			if size == 0 {
+				return false
+			}
+			size = 0
+			continue
+		}
+		size++
+	}
+	return depth == 0 && size > 0
+}
+
+// Eval evaluates the template against a JSON document, which is
+// copied, EvalContext evaluates it against a document in bytes.
 func (t *T) Eval(data string) (string, error) {
-	var b bytes.Buffer
+	return t.EvalContext(&Context{JSON: []byte(data)})
+}
+
+// EvalContext evaluates the template against a context.
+func (t *T) EvalContext(ctx *Context) (string, error) {
+	b := buffers.Get().(*bytes.Buffer)
+	defer buffers.Put(b)
+	b.Reset()
+
 	for _, n := range t.nodes {
-		b.WriteString(n.Eval(data))
+		if err := n.Eval(b, ctx, t.Strict); err != nil {
+			return "", err
+		}
+	}
+
+	if t.Sanitizer != nil {
+		return t.Sanitizer.Sanitize(b.String())
 	}
 	return b.String(), nil
 }
 
+// EvalAll evaluates the template against a context. Variables
+// referencing an array produce one result per element, and with
+// several arrays one per combination of their elements. Duplicate
+// results are removed, an empty array produces no results.
+func (t *T) EvalAll(ctx *Context) ([]string, error) {
+	if !t.fansOut(ctx) {
+		s, err := t.EvalContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return []string{s}, nil
+	}
+
+	results := []string{""}
+	for _, n := range t.nodes {
+		values, err := n.EvalAll(ctx, t.Strict)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(values) == 1 {
+			for i := range results {
+				results[i] += values[0]
+			}
+			continue
+		}
+
+		product := make([]string, 0, len(results)*len(values))
+		for _, r := range results {
+			for _, v := range values {
+				product = append(product, r+v)
+			}
+		}
+		results = product
+	}
+
+	if t.Sanitizer != nil {
+		for i, r := range results {
+			s, err := t.Sanitizer.Sanitize(r)
+			if err != nil {
+				return nil, err
+			}
+			results[i] = s
+		}
+	}
+
+	return unique(results), nil
+}
+
+// fansOut returns true if a variable of the
+// template references an array in ctx.
+func (t *T) fansOut(ctx *Context) bool {
+	for _, n := range t.vars {
+		if isArray(n.lookup(ctx)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isArray returns true if r is an array.
+func isArray(r gjson.Result) bool {
+	return r.Type == gjson.JSON && r.Raw[0] == '['
+}
+
+// unique removes duplicates from s, preserving order.
+func unique(s []string) []string {
+	if len(s) < 2 {
+		return s
+	}
+
+	seen := make(map[string]struct{}, len(s))
+	u := s[:0]
+	for _, v := range s {
+		if _, ok := seen[v]; !ok {
+			seen[v] = struct{}{}
+			u = append(u, v)
+		}
+	}
+	return u
+}
+
+// now returns the current time, {@now} evaluates to it.
+var now = time.Now
+
 type node struct {
-	variable string
 	literal  string
+	expr     string   // as written, with filters
+	variable string   // as written, without filters
+	paths    []string // alternatives, the first present and not empty is used
+	filters  []filter
+	section  []node // optional section
+}
+
+// Eval renders the node into b.
+func (n node) Eval(b *bytes.Buffer, ctx *Context, strict bool) error {
+	switch {
+	case n.section != nil:
+		return n.evalSection(b, ctx, strict)
+	case n.variable == "":
+		b.WriteString(n.literal)
+		return nil
+	}
+
+	v, err := n.apply(n.lookup(ctx), strict)
+	if err != nil {
+		return err
+	}
+
+	if strict && !v.exists {
+		return &Error{n.variable, ErrMissingField}
+	}
+
+	b.WriteString(v.str)
+	return nil
 }
 
-func (n node) Eval(data string) string {
-	if n.variable == "" {
-		return n.literal
+// EvalAll returns the values of the node,
+// one per element if it references an array.
+func (n node) EvalAll(ctx *Context, strict bool) ([]string, error) {
+	switch {
+	case n.section != nil:
+		return n.evalSectionAll(ctx, strict)
+	case n.variable == "":
+		return []string{n.literal}, nil
+	}
+
+	values, err := n.values(ctx, strict)
+	if err != nil {
+		return nil, err
+	}
+
+	strs := make([]string, len(values))
+	for i, v := range values {
+		if strict && !v.exists {
+			return nil, &Error{n.variable, ErrMissingField}
+		}
+		strs[i] = v.str
 	}
+	return strs, nil
+}
+
+// evalSection renders an optional section into b, which renders
+// nothing if any of its variables is missing or empty.
+func (n node) evalSection(b *bytes.Buffer, ctx *Context, strict bool) error {
+	start := b.Len()
+	for _, c := range n.section {
+		if c.variable == "" {
+			b.WriteString(c.literal)
+			continue
+		}
+
+		v, err := c.apply(c.lookup(ctx), strict)
+		if err != nil {
+			return err
+		}
+
+		if empty(v) {
+			b.Truncate(start)
+			return nil
+		}
+		b.WriteString(v.str)
+	}
+	return nil
+}
+
+// evalSectionAll evaluates an optional section with the
+// variables referencing arrays producing one result per
+// element, combinations with an empty value evaluate
+// to nothing.
+func (n node) evalSectionAll(ctx *Context, strict bool) ([]string, error) {
+	type result struct {
+		str string
+		ok  bool
+	}
+
+	results := []result{{"", true}}
+	for _, c := range n.section {
+		if c.variable == "" {
+			for i := range results {
+				results[i].str += c.literal
+			}
+			continue
+		}
+
+		values, err := c.values(ctx, strict)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(values) == 0 {
+			values = []value{{}}
+		}
+
+		product := make([]result, 0, len(results)*len(values))
+		for _, r := range results {
+			for _, v := range values {
+				product = append(product, result{r.str + v.str, r.ok && !empty(v)})
+			}
+		}
+		results = product
+	}
+
+	strs := make([]string, len(results))
+	for i, r := range results {
+		if r.ok {
+			strs[i] = r.str
+		}
+	}
+	return strs, nil
+}
+
+// values returns the values of the variable,
+// one per element if it references an array.
+func (n node) values(ctx *Context, strict bool) ([]value, error) {
+	r := n.lookup(ctx)
+	if !isArray(r) {
+		v, err := n.apply(r, strict)
+		if err != nil {
+			return nil, err
+		}
+		return []value{v}, nil
+	}
+
+	elements := r.Array()
+	values := make([]value, 0, len(elements))
+	for _, e := range elements {
+		v, err := n.apply(e, strict)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// lookup returns the raw value of the first
+// alternative that is present and not empty.
+func (n node) lookup(ctx *Context) gjson.Result {
+	var r gjson.Result
+	for _, path := range n.paths {
+		r = lookup(ctx, path)
+		if r.Exists() && r.Type != gjson.Null && r.String() != "" {
+			break
+		}
+	}
+	return r
+}
+
+// lookup returns the raw value of path.
+func lookup(ctx *Context, path string) gjson.Result {
+	switch {
+	case path == "@now":
+		return gjson.Result{Type: gjson.String, Str: now().UTC().Format(time.RFC3339Nano)}
+	case strings.HasPrefix(path, "@"):
+		s, ok := ctx.Vars[path[1:]]
+		if !ok {
+			return gjson.Result{}
+		}
+		return gjson.Result{Type: gjson.String, Str: s}
+	default:
+		return ctx.Get(path)
+	}
+}
+
+// apply passes the raw value through the filters.
+func (n node) apply(r gjson.Result, strict bool) (value, error) {
+	if strict && r.Type == gjson.JSON {
+		return value{}, &Error{n.variable, ErrNonScalar}
+	}
+
+	v := value{str: r.String(), exists: r.Exists() && r.Type != gjson.Null}
+
+	for _, f := range n.filters {
+		var err error
+		v, err = f(v)
+		if err != nil {
+			return value{}, &Error{n.variable, err}
+		}
+	}
+
+	return v, nil
+}
 
-	return gjson.Get(data, n.variable).String()
+// empty returns true if v is missing or empty.
+func empty(v value) bool {
+	return !v.exists || v.str == ""
 }
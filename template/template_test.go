@@ -3,7 +3,10 @@ package template_test
 import (
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	interpolate "github.com/segmentio/go-interpolate"
 	"github.com/segmentio/nsq_to_redis/template"
@@ -45,13 +48,20 @@ func TestValidTemplates(t *testing.T) {
 		{"integration-errors:project:{projectId}:ingress", `{"projectId":"p"}`, "integration-errors:project:p:ingress"},
 		{"stream:project:{projectId}:ingress", `{"projectId":"foo"}`, "stream:project:foo:ingress"},
 		{"stream:persist:{projectId}:ingress", `{"projectId":"foo"}`, "stream:persist:foo:ingress"},
+		{"{{", `{}`, "{"},
+		{"}}", `{}`, "}"},
+		{"{{}", `{}`, "{}"},
+		{"{{projectId}}", `{"projectId":"foo"}`, "{projectId}"},
+		{"events:{{{projectId}}}", `{"projectId":"foo"}`, "events:{foo}"},
+		{"events:{projectId}}}", `{"projectId":"foo"}`, "events:foo}"},
+		{"events:{projectId|hashtag}:ingress", `{"projectId":"foo"}`, "events:{foo}:ingress"},
 	}
 
 	for _, tc := range testCases {
 		t.Run(fmt.Sprintf("%q.Eval(`%s`)", tc.format, tc.data), func(t *testing.T) {
 			tmpl, err := template.New(tc.format)
 			if err != nil {
-				t.Error("expected New to not error, but did: %v", err)
+				t.Errorf("expected New to not error, but did: %v", err)
 			}
 
 			got, err := tmpl.Eval(tc.data)
@@ -66,6 +76,602 @@ func TestValidTemplates(t *testing.T) {
 	}
 }
 
+func TestSections(t *testing.T) {
+	testCases := []struct {
+		format   string
+		data     string
+		expected string
+	}{
+		{"{userId||anonymousId}", `{"userId":"u","anonymousId":"a"}`, "u"},
+		{"{userId||anonymousId}", `{"anonymousId":"a"}`, "a"},
+		{"{userId||anonymousId}", `{"userId":"","anonymousId":"a"}`, "a"},
+		{"{userId||anonymousId}", `{"userId":null,"anonymousId":"a"}`, "a"},
+		{"{userId||anonymousId|upper}", `{"anonymousId":"a"}`, "A"},
+		{"{userId||anonymousId|default:none}", `{}`, "none"},
+		{"{userId||context.traits.id||anonymousId}", `{"context":{"traits":{"id":"t"}}}`, "t"},
+		{"events[:{event}]", `{"event":"e"}`, "events:e"},
+		{"events[:{event}]", `{}`, "events"},
+		{"events[:{event}]", `{"event":""}`, "events"},
+		{"events[:{event}]:all", `{"event":null}`, "events:all"},
+		{"events[:{a}:{b}]", `{"a":"x"}`, "events"},
+		{"events[:{a}:{b}]", `{"a":"x","b":"y"}`, "events:x:y"},
+		{"events[:{a||b}]", `{"b":"y"}`, "events:y"},
+		{"events[:{a|default:x}]", `{}`, "events:x"},
+		{"events[:literal]", `{}`, "events:literal"},
+		{"[[{a}]]", `{"a":"x"}`, "[x]"},
+		{"a]b", `{}`, "a]b"},
+		{"[{a}]]]", `{"a":"x"}`, "x]"},
+		{"[{a}]]", `{"a":"x"}`, "x]"},
+		{"[{a}]]", `{}`, "]"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%q.Eval(`%s`)", tc.format, tc.data), func(t *testing.T) {
+			tmpl, err := template.New(tc.format)
+			if err != nil {
+				t.Fatalf("expected New to not error, but did: %v", err)
+			}
+
+			got, err := tmpl.Eval(tc.data)
+			if err != nil {
+				t.Errorf("expected Eval to not error, but did: %v", err)
+			}
+
+			if got != tc.expected {
+				t.Errorf("expected eval to return %q, but got: %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestSectionsInvalid(t *testing.T) {
+	testCases := []struct {
+		format   string
+		expected error
+	}{
+		{"[", template.ErrMissingClosingBracket},
+		{"events[:{event}", template.ErrMissingClosingBracket},
+		{"[a[b]]", template.ErrNestedSection},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%q", tc.format), func(t *testing.T) {
+			_, err := template.New(tc.format)
+			if err != tc.expected {
+				t.Errorf("expected New to fail with %v, but got: %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestSectionsStrict(t *testing.T) {
+	testCases := []struct {
+		format   string
+		data     string
+		expected string
+		err      error
+	}{
+		{"events[:{event}]", `{}`, "events", nil},
+		{"events[:{event}]", `{"event":null}`, "events", nil},
+		{"events[:{event}]", `{"event":{"a":1}}`, "", template.ErrNonScalar},
+		{"{userId||anonymousId}", `{"anonymousId":"a"}`, "a", nil},
+		{"{userId||anonymousId}", `{"userId":""}`, "", template.ErrMissingField},
+		{"{userId||anonymousId}", `{}`, "", template.ErrMissingField},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%q.Eval(`%s`)", tc.format, tc.data), func(t *testing.T) {
+			tmpl, err := template.New(tc.format)
+			if err != nil {
+				t.Fatalf("expected New to not error, but did: %v", err)
+			}
+			tmpl.Strict = true
+
+			got, err := tmpl.Eval(tc.data)
+			if tc.err == nil && err != nil {
+				t.Errorf("expected Eval to not error, but did: %v", err)
+			}
+
+			if tc.err != nil {
+				if e, ok := err.(*template.Error); !ok || e.Err != tc.err {
+					t.Errorf("expected Eval to fail with %v, but got: %v", tc.err, err)
+				}
+			}
+
+			if got != tc.expected {
+				t.Errorf("expected eval to return %q, but got: %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestEmptyVariable(t *testing.T) {
+	for _, format := range []string{"{}", "events:{}", "{a||}", "{||a}", "{|upper}"} {
+		t.Run(fmt.Sprintf("%q", format), func(t *testing.T) {
+			_, err := template.New(format)
+			if e, ok := err.(*template.Error); !ok || e.Err != template.ErrEmptyVariable {
+				t.Errorf("expected New to fail with %v, but got: %v", template.ErrEmptyVariable, err)
+			}
+		})
+	}
+}
+
+func TestVariables(t *testing.T) {
+	testCases := []struct {
+		format   string
+		expected []string
+	}{
+		{"events", nil},
+		{"{{literal}}", nil},
+		{"{@topic}:{projectId|lower}", []string{"@topic", "projectId"}},
+		{"{userId||anonymousId}[:{event}]", []string{"userId", "anonymousId", "event"}},
+		{"{a}:{b}:{a|upper}", []string{"a", "b"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%q", tc.format), func(t *testing.T) {
+			tmpl, err := template.New(tc.format)
+			if err != nil {
+				t.Fatalf("expected New to not error, but did: %v", err)
+			}
+
+			if got := tmpl.Variables(); fmt.Sprint(got) != fmt.Sprint(tc.expected) {
+				t.Errorf("expected Variables to return %q, but got: %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		format   string
+		expected error
+	}{
+		{"events:{projectId}", nil},
+		{"{a}:{a|upper}", nil},
+		{"{integrations.#.name}", nil},
+		{`{friends.#[last="Murphy"].first}`, nil},
+		{`{fav\.movie}`, nil},
+		{"{@topic}:{@topic|upper}", nil},
+		{"{a}:{a}", template.ErrDuplicateVariable},
+		{"{a|upper}[:{a|upper}]", template.ErrDuplicateVariable},
+		{"{a.}", template.ErrInvalidPath},
+		{"{.a}", template.ErrInvalidPath},
+		{"{a..b}", template.ErrInvalidPath},
+		{`{a\}`, template.ErrInvalidPath},
+		{"{a.#[b=1}", template.ErrInvalidPath},
+		{"{b||a.}", template.ErrInvalidPath},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%q", tc.format), func(t *testing.T) {
+			tmpl, err := template.New(tc.format)
+			if err != nil {
+				t.Fatalf("expected New to not error, but did: %v", err)
+			}
+
+			err = tmpl.Validate()
+			if tc.expected == nil && err != nil {
+				t.Errorf("expected Validate to not error, but did: %v", err)
+			}
+
+			if tc.expected != nil {
+				if e, ok := err.(*template.Error); !ok || e.Err != tc.expected {
+					t.Errorf("expected Validate to fail with %v, but got: %v", tc.expected, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSample(t *testing.T) {
+	tmpl, err := template.New("events:{projectId}[:{event}]")
+	if err != nil {
+		t.Fatalf("expected New to not error, but did: %v", err)
+	}
+
+	got, err := tmpl.Sample(`{"projectId":"gy2d"}`)
+	if err != nil {
+		t.Errorf("expected Sample to not error, but did: %v", err)
+	}
+	if fmt.Sprint(got) != "[events:gy2d]" {
+		t.Errorf("expected Sample to return %q, but got: %q", []string{"events:gy2d"}, got)
+	}
+
+	_, err = tmpl.Sample(`{"event":"e"}`)
+	if e, ok := err.(*template.Error); !ok || e.Err != template.ErrMissingField {
+		t.Errorf("expected Sample to fail with %v, but got: %v", template.ErrMissingField, err)
+	}
+
+	if tmpl.Strict {
+		t.Error("expected Sample to leave Strict unchanged")
+	}
+}
+
+func TestFilters(t *testing.T) {
+	testCases := []struct {
+		format   string
+		data     string
+		expected string
+	}{
+		{"{foo|lower}", `{"foo":"GY2d"}`, "gy2d"},
+		{"{foo|upper}", `{"foo":"gy2d"}`, "GY2D"},
+		{"{foo|trim}", `{"foo":"  gy2d\n"}`, "gy2d"},
+		{"{foo|trim|lower}", `{"foo":" GY2D "}`, "gy2d"},
+		{"{foo|md5}", `{"foo":"a"}`, "0cc175b9c0f1b6a831c399e269772661"},
+		{"{foo|sha1}", `{"foo":"a"}`, "86f7e437faa5a7fce15d1ddcb9eaeaea377667b8"},
+		{"{foo|sha256}", `{"foo":"a"}`, "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb"},
+		{"{foo|truncate:3}", `{"foo":"abcdef"}`, "abc"},
+		{"{foo|truncate:3}", `{"foo":"ab"}`, "ab"},
+		{"{foo|truncate:2}", `{"foo":"日本語"}`, "日本"},
+		{"{foo|truncate:0}", `{"foo":"abc"}`, ""},
+		{"{foo|default:us}", `{"foo":"eu"}`, "eu"},
+		{"{foo|default:us}", `{"foo":""}`, "us"},
+		{"{foo|default:us}", `{}`, "us"},
+		{"{foo|default:}", `{}`, ""},
+		{"{foo|default:a:b}", `{}`, "a:b"},
+		{"{foo|default:US|lower}", `{}`, "us"},
+		{"users:{email|trim|lower|sha1}", `{"email":" A "}`, "users:86f7e437faa5a7fce15d1ddcb9eaeaea377667b8"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%q.Eval(`%s`)", tc.format, tc.data), func(t *testing.T) {
+			tmpl, err := template.New(tc.format)
+			if err != nil {
+				t.Fatalf("expected New to not error, but did: %v", err)
+			}
+
+			got, err := tmpl.Eval(tc.data)
+			if err != nil {
+				t.Errorf("expected Eval to not error, but did: %v", err)
+			}
+
+			if got != tc.expected {
+				t.Errorf("expected eval to return %q, but got: %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestTimeFilter(t *testing.T) {
+	testCases := []struct {
+		format   string
+		data     string
+		expected string
+	}{
+		{"{ts|time:2006-01-02}", `{"ts":"2017-04-14T21:49:19.549Z"}`, "2017-04-14"},
+		{"{ts|time:2006010215}", `{"ts":"2017-04-14T21:49:19Z"}`, "2017041421"},
+		{"{ts|time:2006010215}", `{"ts":"2017-04-14T21:49:19-05:00"}`, "2017041502"},
+		{"{ts|time:2006010215}", `{"ts":"2017-04-14T16:49:18-0500"}`, "2017041421"},
+		{"{ts|time:2006-01-02T15:04:05}", `{"ts":1492206559}`, "2017-04-14T21:49:19"},
+		{"{ts|time:2006-01-02T15:04:05}", `{"ts":"1492206559"}`, "2017-04-14T21:49:19"},
+		{"{ts|time:2006-01-02T15:04:05.000}", `{"ts":1492206559549}`, "2017-04-14T21:49:19.549"},
+		{"{ts|time:2006-01-02T15:04:05.000}", `{"ts":1492206559.5}`, "2017-04-14T21:49:19.500"},
+		{"events:{projectId}:{timestamp|time:2006-01-02}", `{"projectId":"gy2d","timestamp":"2017-04-14T21:49:19.549Z"}`, "events:gy2d:2017-04-14"},
+		{"{ts|time:2006|default:none}", `{}`, "none"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%q.Eval(`%s`)", tc.format, tc.data), func(t *testing.T) {
+			tmpl, err := template.New(tc.format)
+			if err != nil {
+				t.Fatalf("expected New to not error, but did: %v", err)
+			}
+
+			got, err := tmpl.Eval(tc.data)
+			if err != nil {
+				t.Errorf("expected Eval to not error, but did: %v", err)
+			}
+
+			if got != tc.expected {
+				t.Errorf("expected eval to return %q, but got: %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestTimeFilterInvalid(t *testing.T) {
+	tmpl, err := template.New("{ts|time:2006}")
+	if err != nil {
+		t.Fatalf("expected New to not error, but did: %v", err)
+	}
+
+	_, err = tmpl.Eval(`{"ts":"yesterday"}`)
+	if e, ok := err.(*template.Error); !ok || e.Err != template.ErrInvalidTime {
+		t.Errorf("expected Eval to fail with %v, but got: %v", template.ErrInvalidTime, err)
+	}
+}
+
+func TestNow(t *testing.T) {
+	tmpl, err := template.New("events:{@now|time:2006}")
+	if err != nil {
+		t.Fatalf("expected New to not error, but did: %v", err)
+	}
+
+	before := time.Now().UTC().Format("2006")
+	got, err := tmpl.Eval(`{}`)
+	after := time.Now().UTC().Format("2006")
+	if err != nil {
+		t.Errorf("expected Eval to not error, but did: %v", err)
+	}
+
+	if got != "events:"+before && got != "events:"+after {
+		t.Errorf("expected eval to return the current year, but got: %q", got)
+	}
+}
+
+func TestContext(t *testing.T) {
+	ctx := &template.Context{
+		JSON: []byte(`{"projectId":"gy2d"}`),
+		Vars: map[string]string{
+			"topic":     "events",
+			"attempts":  "2",
+			"timestamp": "2017-04-14T21:49:19.549Z",
+		},
+	}
+
+	testCases := []struct {
+		format   string
+		expected string
+	}{
+		{"{@topic}:{projectId}", "events:gy2d"},
+		{"{@attempts}", "2"},
+		{"{@timestamp|time:2006-01-02}", "2017-04-14"},
+		{"{@channel|default:none}", "none"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%q", tc.format), func(t *testing.T) {
+			tmpl, err := template.New(tc.format)
+			if err != nil {
+				t.Fatalf("expected New to not error, but did: %v", err)
+			}
+
+			got, err := tmpl.EvalContext(ctx)
+			if err != nil {
+				t.Errorf("expected EvalContext to not error, but did: %v", err)
+			}
+
+			if got != tc.expected {
+				t.Errorf("expected eval to return %q, but got: %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestContextStrict(t *testing.T) {
+	tmpl, err := template.New("{@channel}")
+	if err != nil {
+		t.Fatalf("expected New to not error, but did: %v", err)
+	}
+	tmpl.Strict = true
+
+	_, err = tmpl.EvalContext(&template.Context{JSON: []byte(`{}`)})
+	if e, ok := err.(*template.Error); !ok || e.Err != template.ErrMissingField {
+		t.Errorf("expected EvalContext to fail with %v, but got: %v", template.ErrMissingField, err)
+	}
+}
+
+func TestEvalAll(t *testing.T) {
+	testCases := []struct {
+		format   string
+		data     string
+		expected []string
+	}{
+		{"foo:{bar}", `{"bar":"baz"}`, []string{"foo:baz"}},
+		{"audiences:{audiences}", `{"audiences":["a","b","c"]}`, []string{"audiences:a", "audiences:b", "audiences:c"}},
+		{"audiences:{audiences|upper}", `{"audiences":["a","b"]}`, []string{"audiences:A", "audiences:B"}},
+		{"audiences:{audiences}", `{"audiences":["a","b","a"]}`, []string{"audiences:a", "audiences:b"}},
+		{"audiences:{audiences}", `{"audiences":[]}`, []string{}},
+		{"integrations:{integrations.#.name}", `{"integrations":[{"name":"a"},{"name":"b"}]}`, []string{"integrations:a", "integrations:b"}},
+		{"{a}:{b}", `{"a":["1","2"],"b":["x","y"]}`, []string{"1:x", "1:y", "2:x", "2:y"}},
+		{"{p}:{a}", `{"p":"gy2d","a":[1,2]}`, []string{"gy2d:1", "gy2d:2"}},
+		{"events[:{a}]", `{"a":["x","y"]}`, []string{"events:x", "events:y"}},
+		{"events[:{a}]", `{"a":["x",""]}`, []string{"events:x", "events"}},
+		{"events[:{a}]", `{"a":[]}`, []string{"events"}},
+		{"events[:{a}]", `{}`, []string{"events"}},
+		{"{a||b}", `{"b":["x","y"]}`, []string{"x", "y"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%q.EvalAll(`%s`)", tc.format, tc.data), func(t *testing.T) {
+			tmpl, err := template.New(tc.format)
+			if err != nil {
+				t.Fatalf("expected New to not error, but did: %v", err)
+			}
+
+			got, err := tmpl.EvalAll(&template.Context{JSON: []byte(tc.data)})
+			if err != nil {
+				t.Errorf("expected EvalAll to not error, but did: %v", err)
+			}
+
+			if fmt.Sprint(got) != fmt.Sprint(tc.expected) {
+				t.Errorf("expected EvalAll to return %q, but got: %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestEvalAllStrict(t *testing.T) {
+	tmpl, err := template.New("audiences:{audiences}")
+	if err != nil {
+		t.Fatalf("expected New to not error, but did: %v", err)
+	}
+	tmpl.Strict = true
+
+	got, err := tmpl.EvalAll(&template.Context{JSON: []byte(`{"audiences":["a","b"]}`)})
+	if err != nil {
+		t.Fatalf("expected EvalAll to not error, but did: %v", err)
+	}
+	if !reflect.DeepEqual(got, []string{"audiences:a", "audiences:b"}) {
+		t.Errorf("expected EvalAll to fan out, but got: %q", got)
+	}
+
+	_, err = tmpl.Eval(`{"audiences":["a","b"]}`)
+	if e, ok := err.(*template.Error); !ok || e.Err != template.ErrNonScalar {
+		t.Errorf("expected Eval to fail with %v, but got: %v", template.ErrNonScalar, err)
+	}
+
+	_, err = tmpl.EvalAll(&template.Context{JSON: []byte(`{"audiences":["a",{"b":1}]}`)})
+	if e, ok := err.(*template.Error); !ok || e.Err != template.ErrNonScalar {
+		t.Errorf("expected EvalAll to fail with %v, but got: %v", template.ErrNonScalar, err)
+	}
+
+	_, err = tmpl.EvalAll(&template.Context{JSON: []byte(`{"audiences":["a",null]}`)})
+	if e, ok := err.(*template.Error); !ok || e.Err != template.ErrMissingField {
+		t.Errorf("expected EvalAll to fail with %v, but got: %v", template.ErrMissingField, err)
+	}
+}
+
+func TestInvalidFilters(t *testing.T) {
+	testCases := []struct {
+		format   string
+		expected error
+	}{
+		{"{foo|nope}", template.ErrUnknownFilter},
+		{"{foo|}", template.ErrUnknownFilter},
+		{"{foo|truncate}", template.ErrInvalidArgument},
+		{"{foo|truncate:-1}", template.ErrInvalidArgument},
+		{"{foo|truncate:a}", template.ErrInvalidArgument},
+		{"{foo|time}", template.ErrInvalidArgument},
+		{"{foo|time:}", template.ErrInvalidArgument},
+		{"{@nope}", template.ErrUnknownVariable},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%q", tc.format), func(t *testing.T) {
+			_, err := template.New(tc.format)
+			e, ok := err.(*template.Error)
+			if !ok || e.Err != tc.expected {
+				t.Errorf("expected New to fail with %v, but got: %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestStrict(t *testing.T) {
+	testCases := []struct {
+		format   string
+		data     string
+		expected string
+		err      error
+	}{
+		{"foo:{bar}", `{"bar":"baz"}`, "foo:baz", nil},
+		{"foo:{bar}", `{"bar":1.5}`, "foo:1.5", nil},
+		{"foo:{bar}", `{"bar":false}`, "foo:false", nil},
+		{"foo:{bar}", `{"bar":""}`, "foo:", nil},
+		{"foo:{bar}", `{}`, "", template.ErrMissingField},
+		{"foo:{bar}", `{"bar":null}`, "", template.ErrMissingField},
+		{"foo:{bar}", `{"bar":{"baz":"b"}}`, "", template.ErrNonScalar},
+		{"foo:{bar}", `{"bar":["b"]}`, "", template.ErrNonScalar},
+		{"foo:{bar|default:baz}", `{}`, "foo:baz", nil},
+		{"foo:{bar|default:baz}", `{"bar":null}`, "foo:baz", nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%q.Eval(`%s`)", tc.format, tc.data), func(t *testing.T) {
+			tmpl, err := template.New(tc.format)
+			if err != nil {
+				t.Fatalf("expected New to not error, but did: %v", err)
+			}
+			tmpl.Strict = true
+
+			got, err := tmpl.Eval(tc.data)
+			if tc.err == nil && err != nil {
+				t.Errorf("expected Eval to not error, but did: %v", err)
+			}
+
+			if tc.err != nil {
+				if e, ok := err.(*template.Error); !ok || e.Err != tc.err || e.Variable != "bar" {
+					t.Errorf("expected Eval to fail with %v, but got: %v", tc.err, err)
+				}
+			}
+
+			if got != tc.expected {
+				t.Errorf("expected eval to return %q, but got: %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestSanitizer(t *testing.T) {
+	long := strings.Repeat("a", 40)
+	testCases := []struct {
+		sanitizer template.Sanitizer
+		key       string
+		expected  string
+		err       error
+	}{
+		{template.Sanitizer{}, "events:a b\n", "events:a b\n", nil},
+		{template.Sanitizer{Replacement: '_'}, "events:a b\n", "events:a_b_", nil},
+		{template.Sanitizer{Replacement: '_'}, "events:a\x00\tb", "events:a__b", nil},
+		{template.Sanitizer{Separator: ":"}, "events:a:b", "events:a:b", nil},
+		{template.Sanitizer{Separator: ":"}, "events:", "", template.ErrEmptySegment},
+		{template.Sanitizer{Separator: ":"}, "events::b", "", template.ErrEmptySegment},
+		{template.Sanitizer{Separator: ":"}, ":events", "", template.ErrEmptySegment},
+		{template.Sanitizer{MaxLength: 40}, long, long, nil},
+		{template.Sanitizer{MaxLength: 30}, long, "aaaaaaaaaaaaa~e33cdf9c7f7120b9", nil},
+		{template.Sanitizer{MaxLength: 20}, strings.Repeat("é", 20), "é~f5cacffb632bb494", nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%+v.Sanitize(%q)", tc.sanitizer, tc.key), func(t *testing.T) {
+			got, err := tc.sanitizer.Sanitize(tc.key)
+			if err != tc.err {
+				t.Errorf("expected Sanitize to return error %v, but got: %v", tc.err, err)
+			}
+
+			if got != tc.expected {
+				t.Errorf("expected Sanitize to return %q, but got: %q", tc.expected, got)
+			}
+
+			if tc.sanitizer.MaxLength > 0 && len(got) > tc.sanitizer.MaxLength {
+				t.Errorf("expected Sanitize to return at most %d bytes, but got %d", tc.sanitizer.MaxLength, len(got))
+			}
+		})
+	}
+}
+
+func TestEvalAllSanitizer(t *testing.T) {
+	tmpl, err := template.New("events:{projectId}")
+	if err != nil {
+		t.Fatalf("expected New to not error, but did: %v", err)
+	}
+	tmpl.Sanitizer = &template.Sanitizer{Replacement: '_', Separator: ":"}
+
+	got, err := tmpl.EvalAll(&template.Context{JSON: []byte(`{"projectId":["a b","a\nb"]}`)})
+	if err != nil {
+		t.Errorf("expected EvalAll to not error, but did: %v", err)
+	}
+	if fmt.Sprint(got) != "[events:a_b]" {
+		t.Errorf("expected EvalAll to return %q, but got: %q", []string{"events:a_b"}, got)
+	}
+
+	_, err = tmpl.EvalAll(&template.Context{JSON: []byte(`{"projectId":""}`)})
+	if err != template.ErrEmptySegment {
+		t.Errorf("expected EvalAll to fail with %v, but got: %v", template.ErrEmptySegment, err)
+	}
+}
+
+func TestReason(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected string
+	}{
+		{&template.Error{Variable: "foo", Err: template.ErrMissingField}, "missing_field"},
+		{&template.Error{Variable: "foo", Err: template.ErrNonScalar}, "non_scalar"},
+		{&template.Error{Variable: "foo", Err: template.ErrUnknownFilter}, "invalid"},
+		{template.ErrEmptySegment, "empty_segment"},
+		{template.ErrMissingClosingBrace, "invalid"},
+	}
+
+	for _, tc := range testCases {
+		if got := template.Reason(tc.err); got != tc.expected {
+			t.Errorf("expected Reason(%v) to return %q, but got: %q", tc.err, tc.expected, got)
+		}
+	}
+}
+
 var benchmarkData = []byte(`{
   "anonymousId": "075100b8-0011-4c87-8731-450e5e41858a",
   "context": {
@@ -136,8 +742,34 @@ func BenchmarkTemplate(b *testing.B) {
 		b.Error(err)
 	}
 
+	data := string(benchmarkData)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tmpl.Eval(data)
+	}
+}
+
+// BenchmarkContext evaluates a list and a publish template and
+// looks up a ratelimit key against each message, as broadcast
+// does with two handlers.
+func BenchmarkContext(b *testing.B) {
+	list, err := template.New("stream:project:{projectId}:{context.library.name}")
+	if err != nil {
+		b.Error(err)
+	}
+
+	pubsub, err := template.New("events:{projectId}[:{type}]")
+	if err != nil {
+		b.Error(err)
+	}
+
+	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
-		tmpl.Eval(string(benchmarkData))
+		ctx := &template.Context{JSON: benchmarkData}
+		ctx.Get("projectId")
+		list.EvalAll(ctx)
+		pubsub.EvalAll(ctx)
 	}
 }
 